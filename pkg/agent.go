@@ -0,0 +1,472 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const agentSockEnv = "DEXY_AGENT_SOCK"
+
+var (
+	agentSocket        string
+	agentRefreshBefore time.Duration
+)
+
+// agentCmd runs an ssh-agent style daemon that keeps tokens for every
+// profile in memory, refreshes them before they expire and hands them out
+// over a Unix socket.
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run a background agent that serves tokens over a Unix socket",
+	Long: `Run a background agent that serves tokens over a Unix socket.
+
+The agent keeps tokens for every profile in memory and refreshes them before
+they expire. Set ` + agentSockEnv + ` to the socket path it prints and dexy
+will ask the agent for tokens instead of fetching them itself.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		path := agentSocket
+		if path == "" {
+			var err error
+			if path, err = defaultAgentSocket(); err != nil {
+				log.Fatalf("error while finding agent socket path %v", err)
+			}
+		}
+		l, err := listenAgent(path)
+		if err != nil {
+			log.Fatalf("error while listening on %s %v", path, err)
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			l.Close()
+		}()
+
+		fmt.Printf("%s=%s; export %s;\n", agentSockEnv, path, agentSockEnv)
+		a := newAgent(agentRefreshBefore)
+		a.start()
+		a.serve(l)
+		os.Remove(path)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(agentCmd)
+	agentCmd.Flags().StringVar(&agentSocket, "socket", "", "path of the Unix socket to listen on (default is $XDG_RUNTIME_DIR/dexy/agent.sock or ~/.dexy/agent.sock)")
+	agentCmd.Flags().DurationVar(&agentRefreshBefore, "refresh-before", 2*time.Minute, "how long before expiry to refresh tokens")
+}
+
+// agentRequest is a single line of JSON sent to the agent.
+type agentRequest struct {
+	// Op is one of "token", "invalidate", "forget" or "list".
+	Op       string `json:"op"`
+	Profile  string `json:"profile,omitempty"`
+	Audience string `json:"audience,omitempty"`
+
+	// MinValidity and NonInteractive are the profile settings of the same
+	// name, so a token from the agent is one getToken would have returned.
+	MinValidity    time.Duration `json:"min_validity,omitempty"`
+	NonInteractive bool          `json:"non_interactive,omitempty"`
+
+	// Rejected, for the "token" op, is an access token a server turned
+	// down. The agent hands out a new token instead of it.
+	Rejected string `json:"rejected,omitempty"`
+
+	// Settings is the digest of the profile as the client resolved it from
+	// its flags, environment and config. The agent only answers for a
+	// profile it resolves the same way, and says errAgentSettings otherwise.
+	Settings string `json:"settings,omitempty"`
+}
+
+// errAgentSettings is the agent's answer to a request for a profile it has
+// different settings for, such as one given with flags. The client then
+// gets the token itself.
+const errAgentSettings = agentError("the agent's settings for the profile differ from the client's")
+
+// agentResponse is the agent's single line JSON reply to a request.
+type agentResponse struct {
+	Token    *dexy.Token `json:"token,omitempty"`
+	Profiles []string    `json:"profiles,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type agent struct {
+	refreshBefore time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session is the agent's in memory state for one profile and audience.
+type session struct {
+	mu    sync.Mutex
+	p     *profile
+	tok   *dexy.Token
+	timer *time.Timer
+}
+
+func newAgent(refreshBefore time.Duration) *agent {
+	return &agent{
+		refreshBefore: refreshBefore,
+		sessions:      map[string]*session{},
+	}
+}
+
+// start loads a session for every profile in the config, picking up tokens
+// that are cached or can be refreshed without the user.
+func (a *agent) start() {
+	for _, name := range profileNames() {
+		p, err := loadProfile(name)
+		if err != nil {
+			log.Printf("skipping profile %q: %v", name, err)
+			continue
+		}
+		s := a.session(p)
+		go a.refresh(s)
+	}
+}
+
+func (a *agent) session(p *profile) *session {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sessions[p.CacheKey()]
+	if !ok {
+		s = &session{p: p}
+		a.sessions[p.CacheKey()] = s
+	}
+	return s
+}
+
+// profile loads the profile req is for, as long as the agent resolves it to
+// the same settings as the client.
+func (a *agent) profile(req agentRequest) (*profile, error) {
+	p, err := loadProfile(req.Profile)
+	if req.Settings != "" && (err != nil || p.settingsDigest() != req.Settings) {
+		return nil, errAgentSettings
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Audience = req.Audience
+	return p, nil
+}
+
+// token returns a token for the profile that is valid for at least
+// req.MinValidity, logging in if it has to and req allows it.
+func (a *agent) token(req agentRequest) (*dexy.Token, error) {
+	p, err := a.profile(req)
+	if err != nil {
+		return nil, err
+	}
+	s := a.session(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok.ValidFor(req.MinValidity) && s.tok.AccessToken != req.Rejected {
+		return s.tok, nil
+	}
+	rp := *s.p
+	rp.MinValidity = req.MinValidity
+	rp.NonInteractive = req.NonInteractive
+	var tok *dexy.Token
+	if req.Rejected != "" {
+		tok, err = refreshToken(context.Background(), &rp, &dexy.Token{AccessToken: req.Rejected})
+	} else {
+		tok, err = getToken(context.Background(), &rp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.update(s, tok)
+	return tok, nil
+}
+
+// refresh gets a new token for s in the background. It never starts a login
+// that needs the user; those only happen when a client asks for a token.
+func (a *agent) refresh(s *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := *s.p
+	p.NonInteractive = true
+	p.MinValidity = a.refreshBefore
+	tok, err := getToken(context.Background(), &p)
+	if err != nil {
+		if err != dexy.ErrLoginRequired {
+			log.Printf("error while refreshing token for %s %v", p.CacheKey(), err)
+			// Try again later, as long as the current token is still good.
+			if s.tok.ValidFor(30 * time.Second) {
+				s.schedule(30*time.Second, func() { a.refresh(s) })
+			}
+		}
+		return
+	}
+	a.update(s, tok)
+}
+
+// update stores a new token in s and schedules its refresh.
+func (a *agent) update(s *session, tok *dexy.Token) {
+	s.tok = tok
+	wait := tok.ExpiryTime.Sub(time.Now()) - a.refreshBefore
+	if wait < 10*time.Second {
+		wait = 10 * time.Second
+	}
+	s.schedule(wait, func() { a.refresh(s) })
+}
+
+func (s *session) schedule(d time.Duration, f func()) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(d, f)
+}
+
+// invalidate throws away the token for the profile, keeping its refresh
+// token, so the next request gets a new one.
+func (a *agent) invalidate(req agentRequest) error {
+	p, err := a.profile(req)
+	if err != nil {
+		return err
+	}
+	s := a.session(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.tok = nil
+	return invalidateToken(p)
+}
+
+// forget drops every session for the profile and removes its cached token.
+func (a *agent) forget(name string) error {
+	p, err := loadProfile(name)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	for key, s := range a.sessions {
+		if s.p.Name != p.Name {
+			continue
+		}
+		s.mu.Lock()
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		s.tok = nil
+		s.mu.Unlock()
+		delete(a.sessions, key)
+	}
+	a.mu.Unlock()
+	return forgetToken(p)
+}
+
+func (a *agent) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *agent) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req agentRequest
+		var resp agentResponse
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("malformed request %v", err)
+			enc.Encode(resp)
+			return
+		}
+
+		switch req.Op {
+		case "token":
+			tok, err := a.token(req)
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				resp.Token = tok.Public()
+			}
+		case "invalidate":
+			if err := a.invalidate(req); err != nil {
+				resp.Error = err.Error()
+			}
+		case "forget":
+			if err := a.forget(req.Profile); err != nil {
+				resp.Error = err.Error()
+			}
+		case "list":
+			a.mu.Lock()
+			sessions := make(map[string]*session, len(a.sessions))
+			for key, s := range a.sessions {
+				sessions[key] = s
+			}
+			a.mu.Unlock()
+			for key, s := range sessions {
+				s.mu.Lock()
+				if s.tok.Valid() {
+					resp.Profiles = append(resp.Profiles, key)
+				}
+				s.mu.Unlock()
+			}
+			sort.Strings(resp.Profiles)
+		default:
+			resp.Error = fmt.Sprintf("unknown op %q", req.Op)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// profileNames returns the name of every profile in the config.
+func profileNames() []string {
+	var names []string
+	if viper.IsSet("auth") {
+		names = append(names, defaultProfile)
+	}
+	for name := range viper.GetStringMap("profiles") {
+		if name != defaultProfile || len(names) == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func defaultAgentSocket() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" {
+		dir = filepath.Join(dir, "dexy")
+	} else {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".dexy")
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
+
+// listenAgent listens on a Unix socket at path that only the current user
+// can connect to.
+func listenAgent(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already listening on %s", path)
+		}
+		// Left behind by an agent that didn't shut down cleanly.
+		os.Remove(path)
+	}
+
+	// Make sure the socket is never accessible to anyone else, not even
+	// between creating and chmodding it.
+	old := umask(0077)
+	l, err := net.Listen("unix", path)
+	umask(old)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// agentError is an error reported by the agent itself, as opposed to a
+// failure to talk to it.
+type agentError string
+
+func (e agentError) Error() string { return string(e) }
+
+// agentCall sends a single request to the agent listening on path.
+func agentCall(path string, req agentRequest) (*agentResponse, error) {
+	conn, err := net.DialTimeout("unix", path, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Leave time for the agent to log the user in through their browser.
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp agentResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, agentError(resp.Error)
+	}
+	return &resp, nil
+}
+
+// agentToken asks the agent for a token for p, other than rejected if that
+// isn't empty.
+func agentToken(path string, p *profile, rejected string) (*dexy.Token, error) {
+	resp, err := agentCall(path, agentRequest{
+		Op:             "token",
+		Profile:        p.Name,
+		Audience:       p.Audience,
+		MinValidity:    p.MinValidity,
+		NonInteractive: p.NonInteractive,
+		Rejected:       rejected,
+		Settings:       p.settingsDigest(),
+	})
+	if err != nil {
+		if err.Error() == dexy.ErrLoginRequired.Error() {
+			return nil, dexy.ErrLoginRequired
+		}
+		return nil, err
+	}
+	if resp.Token == nil {
+		return nil, agentError("agent returned no token")
+	}
+	return resp.Token, nil
+}
+
+// settingsDigest identifies everything about p that decides which token it
+// gets, other than the audience and the per request settings.
+func (p *profile) settingsDigest() string {
+	c := p.Config
+	b, _ := json.Marshal([]interface{}{
+		c.Name, c.Grant, c.Issuer, c.ClientID, c.ClientSecret, c.Scopes,
+		c.Audiences, c.AuthParams, c.PKCE, c.Require,
+		c.AssertionKeyFile, c.AssertionKeyID, c.AssertionAlg,
+		p.LoginMethod, p.CallbackHost, p.CallbackPort, p.Username,
+		viper.GetString("token_file"),
+	})
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startAgent serves an agent on a socket of its own for the rest of the
+// test, and points tokenFor at it.
+func startAgent(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := listenAgent(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go newAgent(2 * time.Minute).serve(l)
+	t.Setenv(agentSockEnv, path)
+	return path
+}
+
+func TestAgentProtocol(t *testing.T) {
+	iss := useIssuer(t, "")
+	path := startAgent(t)
+	p, err := loadProfile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := p.settingsDigest()
+
+	// The steps run in order against the same agent. A step's token is
+	// compared with the one from the step named in same or differ. Tokens
+	// from the dev issuer only differ if their expiry does, so steps that
+	// want a new token issue them for another ttl.
+	tokens := map[string]string{}
+	tests := []struct {
+		name     string
+		req      agentRequest
+		wantErr  string
+		same     string
+		differ   string
+		ttl      time.Duration
+		profiles []string
+	}{
+		{name: "nothing yet", req: agentRequest{Op: "list"}},
+		{name: "token", req: agentRequest{Op: "token", Settings: settings}},
+		{name: "token again", req: agentRequest{Op: "token", Profile: "default", Settings: settings}, same: "token"},
+		{name: "list", req: agentRequest{Op: "list"}, profiles: []string{p.CacheKey()}},
+		{name: "rejected", req: agentRequest{Op: "token", Settings: settings}, differ: "token", ttl: 50 * time.Minute},
+		{name: "after rejecting", req: agentRequest{Op: "token", Settings: settings}, same: "rejected"},
+		{name: "other settings", req: agentRequest{Op: "token", Settings: "other"}, wantErr: string(errAgentSettings)},
+		{name: "no settings", req: agentRequest{Op: "token"}, same: "rejected"},
+		{name: "no such profile", req: agentRequest{Op: "token", Profile: "missing"}, wantErr: `no profile named "missing"`},
+		{name: "unknown profile with settings", req: agentRequest{Op: "token", Profile: "missing", Settings: settings},
+			wantErr: string(errAgentSettings)},
+		{name: "invalidate", req: agentRequest{Op: "invalidate", Settings: settings}},
+		{name: "after invalidating", req: agentRequest{Op: "token", Settings: settings}, differ: "rejected", ttl: 40 * time.Minute},
+		{name: "forget", req: agentRequest{Op: "forget", Profile: "default"}},
+		{name: "forgotten", req: agentRequest{Op: "list"}},
+		{name: "unknown op", req: agentRequest{Op: "sign"}, wantErr: `unknown op "sign"`},
+	}
+	for _, tt := range tests {
+		if tt.name == "rejected" {
+			tt.req.Rejected = tokens["token"]
+		}
+		if tt.ttl != 0 {
+			iss.TokenTTL = tt.ttl
+		}
+		resp, err := agentCall(path, tt.req)
+		if tt.wantErr != "" {
+			if _, ok := err.(agentError); !ok || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error %v, want %q from the agent", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(resp.Profiles, tt.profiles) {
+			t.Errorf("%s: profiles %q, want %q", tt.name, resp.Profiles, tt.profiles)
+		}
+		if tt.req.Op != "token" {
+			continue
+		}
+		if resp.Token == nil || resp.Token.AccessToken == "" {
+			t.Fatalf("%s: no token", tt.name)
+		}
+		if resp.Token.RefreshToken != "" {
+			t.Errorf("%s: the agent handed out a refresh token", tt.name)
+		}
+		tokens[tt.name] = resp.Token.AccessToken
+		if tt.same != "" && tokens[tt.same] != resp.Token.AccessToken {
+			t.Errorf("%s: got a new token, want the one from %q", tt.name, tt.same)
+		}
+		if tt.differ != "" && tokens[tt.differ] == resp.Token.AccessToken {
+			t.Errorf("%s: got the token from %q again, want a new one", tt.name, tt.differ)
+		}
+	}
+}
+
+func TestAgentMalformedRequest(t *testing.T) {
+	useIssuer(t, "")
+	conn, err := net.Dial("unix", startAgent(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("token please\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(line, "malformed request") {
+		t.Errorf("got %q, %v, want a malformed request error", line, err)
+	}
+}
+
+func TestTokenForViaAgent(t *testing.T) {
+	iss := useIssuer(t, "")
+	path := startAgent(t)
+	ctx := context.Background()
+	p, err := loadProfile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := tokenFor(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := agentCall(path, agentRequest{Op: "list"})
+	if err != nil || len(resp.Profiles) != 1 {
+		t.Fatalf("agent has sessions %v, %v, want the profile's", resp, err)
+	}
+
+	// A rejected token is replaced in the agent, not just for this client.
+	iss.TokenTTL = 50 * time.Minute
+	refreshed, err := refreshFor(ctx, p, tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.AccessToken == tok.AccessToken {
+		t.Error("refreshFor returned the rejected token")
+	}
+	if again, err := tokenFor(ctx, p); err != nil || again.AccessToken != refreshed.AccessToken {
+		t.Errorf("agent handed out %v, %v after the refresh, want the new token", again, err)
+	}
+
+	// A profile overridden on the client's side is fetched without the
+	// agent, which would answer for its own settings.
+	other := *p
+	other.Scopes = []string{"openid", "groups"}
+	if _, err := tokenFor(ctx, &other); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := agentCall(path, agentRequest{Op: "list"}); err != nil || len(resp.Profiles) != 1 {
+		t.Errorf("agent has sessions %v, %v, want only the first", resp, err)
+	}
+
+	// Nor is an agent that isn't running any reason to fail.
+	t.Setenv(agentSockEnv, filepath.Join(t.TempDir(), "gone.sock"))
+	if _, err := tokenFor(ctx, p); err != nil {
+		t.Errorf("tokenFor failed without the agent: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// Authorization request parameters with their own flags. connector_id is
+// dex specific and skips its connector chooser; the rest are from OpenID
+// Connect Core section 3.1.2.1.
+var namedAuthParams = []struct {
+	param string
+	flag  string
+	usage string
+}{
+	{"connector_id", "connector-id", "dex connector to log in with, skipping the connector chooser"},
+	{"prompt", "prompt", "whether to prompt for login, consent or select_account"},
+	{"login_hint", "login-hint", "hint about the user logging in, usually their email address"},
+	{"max_age", "max-age", "maximum seconds since the user last authenticated"},
+	{"acr_values", "acr-values", "requested authentication context class references"},
+	{"ui_locales", "ui-locales", "preferred languages for the login page"},
+}
+
+var (
+	namedAuthParamValues = map[string]*string{}
+	extraAuthParams      []string
+)
+
+// addAuthParamFlags adds flags for setting authorization request parameters
+// on a single invocation.
+func addAuthParamFlags(flags *pflag.FlagSet) {
+	for _, p := range namedAuthParams {
+		v, ok := namedAuthParamValues[p.param]
+		if !ok {
+			v = new(string)
+			namedAuthParamValues[p.param] = v
+		}
+		flags.StringVar(v, p.flag, "", p.usage)
+	}
+	flags.StringArrayVar(&extraAuthParams, "auth-param", nil,
+		"extra key=value parameter for the authorization request, may be repeated")
+}
+
+// flagAuthParams returns the authorization request parameters set on the
+// command line.
+func flagAuthParams() (map[string]string, error) {
+	params := map[string]string{}
+	for name, v := range namedAuthParamValues {
+		if *v != "" {
+			params[name] = *v
+		}
+	}
+	for _, kv := range extraAuthParams {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("auth param %q is not in key=value form", kv)
+		}
+		params[kv[:i]] = kv[i+1:]
+	}
+	return params, nil
+}
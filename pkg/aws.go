@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var awsOpts struct {
+	roleARN     string
+	sessionName string
+	duration    time.Duration
+	region      string
+	endpoint    string
+}
+
+// awsCmd swaps the profile's ID token for temporary AWS credentials, in the
+// format ~/.aws/config's credential_process expects.
+var awsCmd = &cobra.Command{
+	Use:   "aws",
+	Short: "Print AWS credentials for a role assumed with the profile's ID token",
+	Long: `Print AWS credentials for a role assumed with the profile's ID token.
+
+The ID token is sent to STS AssumeRoleWithWebIdentity and the temporary
+credentials are printed in the credential_process format, so they can be
+used from ~/.aws/config:
+
+  [profile dev]
+  credential_process = dexy aws --profile default --role-arn arn:aws:iam::123456789012:role/dev
+
+Credentials are cached until they expire.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := loadProfile(profileName)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		creds, err := awsCredentials(context.Background(), p)
+		if err != nil {
+			log.Fatalf("error while getting AWS credentials %v", err)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(creds); err != nil {
+			log.Fatalf("error while writing AWS credentials %v", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(awsCmd)
+	flags := awsCmd.Flags()
+	flags.StringVar(&awsOpts.roleARN, "role-arn", "", "ARN of the role to assume (default is the profile's aws.role_arn)")
+	flags.StringVar(&awsOpts.sessionName, "session-name", "", "role session name (default is the user's email or subject)")
+	flags.DurationVar(&awsOpts.duration, "duration", 0, "how long the credentials should last (default is the role's default)")
+	flags.StringVar(&awsOpts.region, "region", "", "use the regional STS endpoint for this region")
+	flags.StringVar(&awsOpts.endpoint, "sts-endpoint", "", "STS endpoint URL (default is https://sts.amazonaws.com)")
+}
+
+// awsProcessCredentials is the output format of a credential_process.
+type awsProcessCredentials struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+type stsResponse struct {
+	Credentials stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+type stsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// awsCredentials returns cached credentials for the role, or assumes it
+// with the profile's ID token.
+func awsCredentials(ctx context.Context, p *profile) (*awsProcessCredentials, error) {
+	roleARN := awsOpts.roleARN
+	if roleARN == "" {
+		roleARN = viper.GetString(p.key + ".aws.role_arn")
+	}
+	if roleARN == "" {
+		return nil, errors.New("no role to assume, set --role-arn or aws.role_arn in the profile")
+	}
+	duration := awsOpts.duration
+	if duration == 0 {
+		duration = viper.GetDuration(p.key + ".aws.duration")
+	}
+	endpoint := awsOpts.endpoint
+	if endpoint == "" {
+		endpoint = viper.GetString(p.key + ".aws.sts_endpoint")
+	}
+	region := awsOpts.region
+	if region == "" {
+		region = viper.GetString(p.key + ".aws.region")
+	}
+	if endpoint == "" {
+		endpoint = "https://sts.amazonaws.com"
+		if region != "" {
+			endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", region)
+		}
+	}
+
+	// Credentials for the same role from another endpoint, with another
+	// duration or session name are different credentials. An empty session
+	// name stands for the one made from the ID token.
+	store := tokenCache()
+	key := p.CacheKey() + "#aws:" + url.Values{
+		"role_arn":     {roleARN},
+		"endpoint":     {endpoint},
+		"duration":     {duration.String()},
+		"session_name": {awsOpts.sessionName},
+	}.Encode()
+	if cached := store.Get(key); cached.ValidFor(time.Minute) {
+		return processCredentials(cached), nil
+	}
+
+	idToken, err := tokenFor(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	sessionName := awsOpts.sessionName
+	if sessionName == "" {
+		sessionName = awsSessionName(idToken.AccessToken)
+	}
+
+	creds, err := assumeRoleWithWebIdentity(ctx, endpoint, roleARN, sessionName, idToken.AccessToken, duration)
+	if err != nil {
+		return nil, err
+	}
+	tok := &dexy.Token{
+		AccessToken: creds.SessionToken,
+		ExpiryTime:  creds.Expiration,
+		Data: map[string]string{
+			"access_key_id":     creds.AccessKeyID,
+			"secret_access_key": creds.SecretAccessKey,
+		},
+		// The credentials are only as fresh as the login behind the ID
+		// token, as far as max_cache_lifetime is concerned.
+		LoginTime: idToken.LoginTime,
+	}
+	if err := store.Put(key, tok); err != nil {
+		return nil, fmt.Errorf("error while attempting to write token to file %v", err)
+	}
+	return processCredentials(tok), nil
+}
+
+func processCredentials(tok *dexy.Token) *awsProcessCredentials {
+	return &awsProcessCredentials{
+		Version:         1,
+		AccessKeyID:     tok.Data["access_key_id"],
+		SecretAccessKey: tok.Data["secret_access_key"],
+		SessionToken:    tok.AccessToken,
+		Expiration:      tok.ExpiryTime.UTC().Format(time.RFC3339),
+	}
+}
+
+var invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// awsSessionName names the role session after the user, so CloudTrail shows
+// who assumed the role.
+func awsSessionName(idToken string) string {
+	var c dexy.Claims
+	dexy.UnverifiedClaims(idToken, &c)
+	name := c.Email
+	if name == "" {
+		name = c.Subject
+	}
+	name = invalidSessionNameChars.ReplaceAllString(name, "-")
+	if len(name) < 2 {
+		name = "dexy"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// assumeRoleWithWebIdentity calls STS. The call is authenticated by the
+// token alone, so it needs no AWS credentials or request signing.
+func assumeRoleWithWebIdentity(ctx context.Context, endpoint, roleARN, sessionName, token string, duration time.Duration) (*stsCredentials, error) {
+	v := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {token},
+	}
+	if duration > 0 {
+		v.Set("DurationSeconds", strconv.Itoa(int(duration.Seconds())))
+	}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e stsErrorResponse
+		if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("sts: %s: %s", e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("sts: %s: %s", resp.Status, body)
+	}
+	var r stsResponse
+	if err := xml.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("sts: cannot decode response %v", err)
+	}
+	if r.Credentials.AccessKeyID == "" {
+		return nil, errors.New("sts: response has no credentials")
+	}
+	return &r.Credentials, nil
+}
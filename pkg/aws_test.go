@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/chronojam/dexy/pkg/dexy/dexytest"
+	"github.com/spf13/viper"
+)
+
+func TestAWSSessionName(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+	idToken := func(claims map[string]interface{}) string {
+		iss.User.Claims = claims
+		tok, err := iss.IDToken("dexy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	tests := []struct {
+		name    string
+		idToken string
+		want    string
+	}{
+		{"email", idToken(nil), "test@example.com"},
+		{"subject without email", idToken(map[string]interface{}{"email": ""}), "CgR0ZXN0EgVsb2NhbA"},
+		{"invalid characters", idToken(map[string]interface{}{"email": "first last/x@example.com"}), "first-last-x@example.com"},
+		{"too short", idToken(map[string]interface{}{"email": "", "sub": "x"}), "dexy"},
+		{"too long", idToken(map[string]interface{}{"email": strings.Repeat("a", 70)}), strings.Repeat("a", 64)},
+		{"not a JWT", "opaque", "dexy"},
+	}
+	for _, tt := range tests {
+		if got := awsSessionName(tt.idToken); got != tt.want {
+			t.Errorf("%s: awsSessionName = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeSTS answers AssumeRoleWithWebIdentity with new credentials every
+// time, and records the requests it was sent.
+type fakeSTS struct {
+	*httptest.Server
+	mu    sync.Mutex
+	calls []map[string]string
+}
+
+func newFakeSTS(t *testing.T) *fakeSTS {
+	s := &fakeSTS{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		call := map[string]string{}
+		for k := range r.PostForm {
+			call[k] = r.PostForm.Get(k)
+		}
+		s.calls = append(s.calls, call)
+		if call["Action"] != "AssumeRoleWithWebIdentity" || call["WebIdentityToken"] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidAction</Code><Message>bad request</Message></Error></ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials>
+<AccessKeyId>AKIA%d</AccessKeyId><SecretAccessKey>secret</SecretAccessKey><SessionToken>session</SessionToken>
+<Expiration>%s</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`,
+			len(s.calls), time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestAWSCredentials(t *testing.T) {
+	useIssuer(t, "    aws:\n      role_arn: arn:aws:iam::123456789012:role/dev\n")
+	sts := newFakeSTS(t)
+	p, err := loadProfile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each call is made with the options of the ones before it changed as
+	// given, and either assumes the role again or is answered from the cache.
+	tests := []struct {
+		name        string
+		set         func()
+		wantKey     string
+		wantRole    string
+		wantSession string
+	}{
+		{"first", func() { awsOpts.endpoint = sts.URL }, "AKIA1", "role/dev", "ci"},
+		{"cached", func() {}, "AKIA1", "", ""},
+		{"other role", func() { awsOpts.roleARN = "arn:aws:iam::123456789012:role/prod" }, "AKIA2", "role/prod", "ci"},
+		{"other duration", func() { awsOpts.duration = 15 * time.Minute }, "AKIA3", "role/prod", "ci"},
+		{"other session name", func() { awsOpts.sessionName = "deploy" }, "AKIA4", "role/prod", "deploy"},
+		{"other endpoint", func() { awsOpts.endpoint = sts.URL + "/" }, "AKIA5", "role/prod", "deploy"},
+		{"back to the first", func() { awsOpts = awsOptsZero; awsOpts.endpoint = sts.URL }, "AKIA1", "", ""},
+	}
+	defer func() { awsOpts = awsOptsZero }()
+	for _, tt := range tests {
+		calls := len(sts.calls)
+		tt.set()
+		creds, err := awsCredentials(context.Background(), p)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if creds.AccessKeyID != tt.wantKey {
+			t.Errorf("%s: got credentials %s, want %s", tt.name, creds.AccessKeyID, tt.wantKey)
+		}
+		if tt.wantSession == "" {
+			if len(sts.calls) != calls {
+				t.Errorf("%s: role assumed again, want the cached credentials", tt.name)
+			}
+			continue
+		}
+		if len(sts.calls) != calls+1 {
+			t.Fatalf("%s: %d calls to STS, want 1", tt.name, len(sts.calls)-calls)
+		}
+		call := sts.calls[calls]
+		if call["RoleSessionName"] != tt.wantSession || call["RoleArn"] != "arn:aws:iam::123456789012:"+tt.wantRole {
+			t.Errorf("%s: assumed %s as %s", tt.name, call["RoleArn"], call["RoleSessionName"])
+		}
+		if want := fmt.Sprint(int(awsOpts.duration.Seconds())); awsOpts.duration > 0 && call["DurationSeconds"] != want {
+			t.Errorf("%s: DurationSeconds = %s, want %s", tt.name, call["DurationSeconds"], want)
+		}
+	}
+}
+
+// awsOptsZero is awsOpts with no flags given.
+var awsOptsZero = awsOpts
+
+func TestAWSCredentialsPerIssuer(t *testing.T) {
+	first := useIssuer(t, "    aws:\n      role_arn: arn:aws:iam::123456789012:role/dev\n")
+	sts := newFakeSTS(t)
+	awsOpts.endpoint = sts.URL
+	defer func() { awsOpts = awsOptsZero }()
+
+	// The same profile pointed at another issuer must not get the
+	// credentials assumed with the first issuer's token.
+	second := dexytest.NewServer()
+	defer second.Close()
+	for _, iss := range []*dexytest.Issuer{first, second} {
+		viper.Set("profiles.default.dex_host", iss.URL)
+		p, err := loadProfile("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := awsCredentials(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+		var c dexy.Claims
+		dexy.UnverifiedClaims(sts.calls[len(sts.calls)-1]["WebIdentityToken"], &c)
+		if c.Issuer != iss.URL {
+			t.Errorf("role assumed with a token from %s, want %s", c.Issuer, iss.URL)
+		}
+	}
+	if len(sts.calls) != 2 {
+		t.Errorf("%d calls to STS, want one per issuer", len(sts.calls))
+	}
+}
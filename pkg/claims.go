@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/viper"
+)
+
+// loadRequirements reads the claims the profile at key requires under its
+// require section.
+func loadRequirements(key string) dexy.Requirements {
+	return dexy.Requirements{
+		EmailVerified: viper.GetBool(key + ".require.email_verified"),
+		EmailDomains:  viper.GetStringSlice(key + ".require.email_domains"),
+		Groups:        viper.GetStringSlice(key + ".require.groups"),
+		HostedDomain:  viper.GetString(key + ".require.hd"),
+		Issuer:        viper.GetString(key + ".require.iss"),
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
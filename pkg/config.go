@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// envKeyReplacer turns config keys into the names of the environment
+// variables that override them, so profiles.ci.client_id can be set with
+// DEXY_PROFILES_CI_CLIENT_ID.
+var envKeyReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// Profile settings, most with their own flags. Flags beat DEXY_ environment
+// variables, which beat the config file. def is only shown by config view,
+// the code using a setting applies its default. Settings without a flag are
+// only listed so config view always shows them.
+var profileSettings = []struct {
+	key     string
+	flag    string
+	slice   bool
+	boolean bool
+	def     string
+	usage   string
+}{
+	{key: "dex_host", flag: "issuer", usage: "issuer URL"},
+	{key: "client_id", flag: "client-id", usage: "client ID"},
+	{key: "client_secret", flag: "client-secret", usage: "client secret, shows up in ps, prefer the environment variable"},
+	{key: "grant", flag: "grant", def: "authorization_code", usage: "grant to get tokens with, authorization_code or client_credentials"},
+	{key: "scopes", flag: "scopes", slice: true, usage: "scopes to request"},
+	{key: "audiences", flag: "audiences", slice: true, usage: "client IDs the ID token should also be issued for"},
+	{key: "pkce", flag: "pkce", boolean: true, usage: "protect the login's authorization code with PKCE"},
+	{key: "login", flag: "login", def: "browser", usage: "how to log in if needed, one of browser, device or paste"},
+	{key: "callback_host", flag: "callback-host", def: "localhost", usage: "host of the browser login's redirect URI, and the address it listens on"},
+	{key: "callback_port", flag: "callback-port", def: "10111", usage: "port the browser login listens on"},
+	{key: "username", flag: "username", usage: "username for --password-grant"},
+	{key: "password_grant", def: "false"},
+	{key: "client_assertion.key_file", flag: "client-assertion-key-file", usage: "private key to authenticate the client with instead of a secret"},
+	{key: "client_assertion.key_id", flag: "client-assertion-key-id", usage: "key ID of the client assertion key"},
+	{key: "client_assertion.alg", flag: "client-assertion-alg", usage: "signing algorithm of the client assertion"},
+	{key: "require.email_verified", flag: "require-email-verified", boolean: true, usage: "reject tokens whose email isn't verified"},
+	{key: "require.email_domains", flag: "require-email-domains", slice: true, usage: "reject tokens whose email isn't in one of these domains"},
+	{key: "require.groups", flag: "require-groups", slice: true, usage: "reject tokens without one of these groups"},
+	{key: "require.hd", flag: "require-hd", usage: "reject tokens without this hd claim"},
+	{key: "require.iss", flag: "require-iss", usage: "reject tokens from another issuer"},
+}
+
+// tokenFileFlag overrides token_file. It isn't --token-file, which exec and
+// watch use for the files they write.
+const tokenFileFlag = "token-cache"
+
+// addSettingFlags adds a flag for each profile setting, and for the token
+// cache.
+func addSettingFlags(flags *pflag.FlagSet) {
+	for _, s := range profileSettings {
+		switch {
+		case s.flag == "":
+		case s.slice:
+			flags.StringSlice(s.flag, nil, s.usage)
+		case s.boolean:
+			flags.Bool(s.flag, false, s.usage)
+		default:
+			flags.String(s.flag, "", s.usage)
+		}
+	}
+	flags.String(tokenFileFlag, "", "file tokens are cached in (default is $HOME/.dexy-token.yaml)")
+}
+
+// bindSettingFlags makes the setting flags override the keys of the profile
+// being used, which needn't be in the config file at all.
+func bindSettingFlags(flags *pflag.FlagSet) {
+	name, key, ok := profileKey(profileName)
+	if !ok {
+		key = "profiles." + name
+	}
+	for _, s := range profileSettings {
+		if s.flag != "" {
+			viper.BindPFlag(key+"."+s.key, flags.Lookup(s.flag))
+		}
+	}
+	viper.BindPFlag("token_file", flags.Lookup(tokenFileFlag))
+}
+
+// envName returns the environment variable overriding key.
+func envName(key string) string {
+	return "DEXY_" + strings.ToUpper(envKeyReplacer.Replace(key))
+}
+
+// settingFlag returns the flag overriding a key of a profile, if it has one.
+func settingFlag(key string) string {
+	for _, s := range profileSettings {
+		if s.key == key {
+			return s.flag
+		}
+	}
+	return ""
+}
+
+// settingValue is a setting as config view and doctor show it.
+type settingValue struct {
+	key    string
+	value  string
+	origin string
+}
+
+// profileValues returns the settings of the profile under key that are set,
+// or have defaults, with where each comes from.
+func profileValues(key string) []settingValue {
+	inFile := map[string]interface{}{}
+	flattenConfig("", viper.Get(key), inFile)
+
+	seen := map[string]bool{}
+	var values []settingValue
+	add := func(k, def string) {
+		if seen[k] {
+			return
+		}
+		seen[k] = true
+		full := key + "." + k
+		v := settingValue{key: k}
+		flag := settingFlag(k)
+		switch {
+		case flag != "" && RootCmd.PersistentFlags().Changed(flag):
+			v.origin = "--" + flag
+		case os.Getenv(envName(full)) != "":
+			v.origin = "$" + envName(full)
+		case configOrigin(full) != "":
+			v.origin = configOrigin(full)
+		case def != "":
+			v.value, v.origin = def, "default"
+			values = append(values, v)
+			return
+		default:
+			return
+		}
+		v.value = displayValue(k, viper.Get(full))
+		values = append(values, v)
+	}
+	for _, s := range profileSettings {
+		add(s.key, s.def)
+	}
+	for k := range inFile {
+		add(strings.TrimPrefix(k, "."), "")
+	}
+	for k := range authParams(key) {
+		add("auth_params."+k, "")
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].key < values[j].key })
+	return values
+}
+
+var secretKeyRe = regexp.MustCompile(`(secret|password|access_token)$`)
+
+// displayValue formats v for showing, redacting secrets.
+func displayValue(key string, v interface{}) string {
+	s := fmt.Sprint(v)
+	if secretKeyRe.MatchString(key) && s != "" {
+		return "<redacted>"
+	}
+	return s
+}
+
+// flattenConfig collects the leaves of a config section under their
+// dotted keys.
+func flattenConfig(prefix string, v interface{}, into map[string]interface{}) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		for k, v := range m {
+			flattenConfig(prefix+"."+k, v, into)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			flattenConfig(fmt.Sprintf("%s.%v", prefix, k), v, into)
+		}
+	default:
+		into[prefix] = v
+	}
+}
+
+// configCmd groups the commands about dexy's own configuration.
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Show dexy's configuration",
+}
+
+var showOrigin bool
+
+// configViewCmd shows the settings a command would use, and with
+// --show-origin where each one comes from.
+var configViewCmd = &cobra.Command{
+	Use:   "view",
+	Short: "Show the profile's settings",
+	Long: `Show the profile's settings, and with --show-origin where each one comes
+from.
+
+dexy merges /etc/dexy/.dexy.yaml, then $HOME/.dexy.yaml, then the .dexy.yaml
+files in the working directory and its parents, nearer ones last, unless
+--config names the only file to read. Project files can only set profile,
+unless their directory is listed in trusted_projects in the system or user
+config. Every setting can also be given as an
+environment variable named after its key (auth.client_id is
+DEXY_AUTH_CLIENT_ID, profiles.ci.scopes is DEXY_PROFILES_CI_SCOPES), and most
+as flags. Flags beat environment variables, which beat the config files. Lists
+in environment variables are separated by spaces. Secrets are redacted.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		line := func(indent, key, value, origin string) {
+			if showOrigin {
+				fmt.Fprintf(w, "%s%s:\t%s\t# %s\n", indent, key, value, origin)
+			} else {
+				fmt.Fprintf(w, "%s%s:\t%s\n", indent, key, value)
+			}
+		}
+		if showOrigin {
+			fmt.Fprintln(w, "# highest first: flags, DEXY_ environment variables, config files, defaults")
+			if _, err := os.Stat(policyFile); err == nil {
+				fmt.Fprintf(w, "# restricted by %s\n", policyFile)
+			}
+			for i := len(configLayers) - 1; i >= 0; i-- {
+				fmt.Fprintf(w, "# merged %s\n", configLayers[i].path)
+			}
+		}
+
+		name, key, ok := profileKey(profileName)
+		if !ok {
+			key = "profiles." + name
+		}
+		nameOrigin := "default"
+		switch {
+		case profileName != "":
+			nameOrigin = "--profile"
+		case os.Getenv(envName("profile")) != "":
+			nameOrigin = "$" + envName("profile")
+		case configOrigin("profile") != "":
+			nameOrigin = configOrigin("profile")
+		}
+		line("", "profile", name, nameOrigin)
+
+		tokenFile := "default"
+		switch {
+		case RootCmd.PersistentFlags().Changed(tokenFileFlag):
+			tokenFile = "--" + tokenFileFlag
+		case os.Getenv(envName("token_file")) != "":
+			tokenFile = "$" + envName("token_file")
+		case configOrigin("token_file") != "":
+			tokenFile = configOrigin("token_file")
+		}
+		line("", "token_file", viper.GetString("token_file"), tokenFile)
+
+		fmt.Fprintf(w, "%s:\n", key)
+		for _, v := range profileValues(key) {
+			line("  ", v.key, v.value, v.origin)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configViewCmd)
+	configViewCmd.Flags().BoolVar(&showOrigin, "show-origin", false, "show the flag, environment variable or file each setting comes from")
+}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/chronojam/dexy/pkg/dexy/dexytest"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// useConfig starts the test with config as the only config file, no policy
+// and no agent, and a token cache of its own.
+func useConfig(t *testing.T, config string) {
+	t.Helper()
+	viper.Reset()
+	configLayers = nil
+	orgPolicy = policy{}
+	profileName, audience, passwordGrant = "", "", false
+	t.Setenv(agentSockEnv, "")
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".dexy.yaml"), config)
+	if err := mergeConfigFile(filepath.Join(dir, ".dexy.yaml"), nil); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetDefault("token_file", filepath.Join(dir, "tokens.yaml"))
+}
+
+// useIssuer starts a dev issuer and a config with a client credentials
+// profile named "default" that logs in at it.
+func useIssuer(t *testing.T, extra string) *dexytest.Issuer {
+	t.Helper()
+	iss := dexytest.NewServer()
+	t.Cleanup(iss.Close)
+	useConfig(t, fmt.Sprintf(`profiles:
+  default:
+    dex_host: %s
+    grant: client_credentials
+    client_id: ci
+    client_secret: s3cret
+%s`, iss.URL, extra))
+	return iss
+}
+
+func writeFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFiles(t *testing.T) {
+	useConfig(t, "")
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := filepath.Join(root, "home")
+	writeFile(t, filepath.Join(home, ".dexy.yaml"), "")
+	writeFile(t, filepath.Join(home, "src", ".dexy.yml"), "")
+	writeFile(t, filepath.Join(home, "src", "repo", ".dexy.yaml"), "")
+	writeFile(t, filepath.Join(root, "work", ".dexy.json"), "{}")
+	os.MkdirAll(filepath.Join(root, "work", "repo"), 0700)
+
+	tests := []struct {
+		name        string
+		wd          string
+		wantProject []string
+	}{
+		{"under home", filepath.Join(home, "src", "repo"), []string{
+			filepath.Join(home, "src", ".dexy.yml"),
+			filepath.Join(home, "src", "repo", ".dexy.yaml"),
+		}},
+		{"home itself", home, nil},
+		{"outside home", filepath.Join(root, "work", "repo"), []string{
+			filepath.Join(root, "work", ".dexy.json"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(tt.wd)
+			base, project := configFiles(home)
+			// The system's file, if this machine has one, comes first.
+			if len(base) == 0 || base[len(base)-1] != filepath.Join(home, ".dexy.yaml") {
+				t.Errorf("base files %q, want the user's last", base)
+			}
+			if !reflect.DeepEqual(project, tt.wantProject) {
+				t.Errorf("project files %q, want %q", project, tt.wantProject)
+			}
+		})
+	}
+}
+
+func TestMergeConfigFile(t *testing.T) {
+	useConfig(t, `profile: dev
+profiles:
+  dev:
+    dex_host: https://user.example.com
+    client_id: dexy
+`)
+	project := filepath.Join(t.TempDir(), ".dexy.yaml")
+	writeFile(t, project, `profile: other
+profiles:
+  dev:
+    dex_host: https://evil.example.com
+trusted_projects: [/]
+`)
+	if err := mergeConfigFile(project, projectKeys); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("profile"); got != "other" {
+		t.Errorf("profile = %q, want the project's", got)
+	}
+	if got := viper.GetString("profiles.dev.dex_host"); got != "https://user.example.com" {
+		t.Errorf("dex_host = %q, want the user's", got)
+	}
+	if got := viper.GetString("profiles.dev.client_id"); got != "dexy" {
+		t.Errorf("client_id = %q, want it kept from the user's file", got)
+	}
+	if got := configLayers[len(configLayers)-1].ignored; !reflect.DeepEqual(got, []string{"profiles", "trusted_projects"}) {
+		t.Errorf("ignored %q, want profiles and trusted_projects", got)
+	}
+	if trustedProject(project) {
+		t.Error("a project trusted itself")
+	}
+}
+
+func TestConfigOrigin(t *testing.T) {
+	useConfig(t, `profiles:
+  dev:
+    dex_host: https://base.example.com
+    client_id: dexy
+`)
+	base := configLayers[0].path
+	override := filepath.Join(t.TempDir(), ".dexy.yaml")
+	writeFile(t, override, `profiles:
+  dev:
+    client_id: other
+    scopes: [groups]
+`)
+	if err := mergeConfigFile(override, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, want string
+	}{
+		{"profiles.dev.dex_host", base},
+		{"profiles.dev.client_id", override},
+		{"Profiles.Dev.Client_ID", override},
+		{"profiles.dev.scopes", override},
+		{"profiles.dev.grant", ""},
+		{"profiles.dev", ""},
+	}
+	for _, tt := range tests {
+		if got := configOrigin(tt.key); got != tt.want {
+			t.Errorf("configOrigin(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestTrustedProject(t *testing.T) {
+	useConfig(t, "trusted_projects: [/srv/work, ~/src, relative]\n")
+	home, err := homedir.Dir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/srv/work/.dexy.yaml", true},
+		{"/srv/work/repo/.dexy.yaml", true},
+		{"/srv/workshop/.dexy.yaml", false},
+		{"/srv/.dexy.yaml", false},
+		{filepath.Join(home, "src", "repo", ".dexy.yaml"), true},
+		{filepath.Join(home, ".dexy.yaml"), false},
+		{"relative/.dexy.yaml", false},
+	}
+	for _, tt := range tests {
+		if got := trustedProject(tt.path); got != tt.want {
+			t.Errorf("trustedProject(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAuthParams(t *testing.T) {
+	useConfig(t, `profiles:
+  dev:
+    auth_params:
+      connector_id: ldap
+      prompt: login
+`)
+	t.Setenv("DEXY_PROFILES_DEV_AUTH_PARAMS_PROMPT", "consent")
+	t.Setenv("DEXY_PROFILES_DEV_AUTH_PARAMS_ORGANIZATION", "acme")
+	t.Setenv("DEXY_PROFILES_DEV_AUTH_PARAMS_EMPTY", "")
+	t.Setenv("DEXY_PROFILES_OTHER_AUTH_PARAMS_X", "y")
+
+	want := map[string]string{"connector_id": "ldap", "prompt": "consent", "organization": "acme"}
+	if got := authParams("profiles.dev"); !reflect.DeepEqual(got, want) {
+		t.Errorf("authParams = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// updateConfig sets keys of the config file given with --config, or of the
+// user's config file, and returns the file's path. Keys are dotted paths like
+// profiles.ci.client_id, and a nil value removes the key. Only YAML files
+// can be updated, and comments in them are lost.
+func updateConfig(values map[string]interface{}) (string, error) {
+	if err := orgPolicy.checkSave(values); err != nil {
+		return "", err
+	}
+	path, b, err := readConfigFile()
+	if err != nil {
+		return "", err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return "", fmt.Errorf("error while parsing %s %v", path, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		doc = setYAMLKey(doc, strings.Split(k, "."), values[k])
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return path, writeFileAtomic(path, out, 0600)
+}
+
+// readConfigFile returns the path and contents of the config file dexy
+// writes to, the one given with --config or else the user's, which needn't
+// exist yet. System and project files are never written.
+func readConfigFile() (string, []byte, error) {
+	path := cfgFile
+	if path == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", nil, err
+		}
+		if path = findConfigFile(home); path == "" {
+			path = filepath.Join(home, ".dexy.yaml")
+		}
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case "", ".yaml", ".yml":
+	default:
+		return "", nil, fmt.Errorf("can't update %s, only YAML config files can be updated", path)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", nil, err
+	}
+	return path, b, nil
+}
+
+// setYAMLKey sets the value at path in m, keeping the order of the keys
+// already there.
+func setYAMLKey(m yaml.MapSlice, path []string, v interface{}) yaml.MapSlice {
+	for i := range m {
+		if fmt.Sprint(m[i].Key) != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			if v == nil {
+				return append(m[:i], m[i+1:]...)
+			}
+			m[i].Value = v
+			return m
+		}
+		child, _ := m[i].Value.(yaml.MapSlice)
+		m[i].Value = setYAMLKey(child, path[1:], v)
+		return m
+	}
+	if v == nil {
+		return m
+	}
+	if len(path) == 1 {
+		return append(m, yaml.MapItem{Key: path[0], Value: v})
+	}
+	return append(m, yaml.MapItem{Key: path[0], Value: setYAMLKey(nil, path[1:], v)})
+}
+
+// configLayer is a config file dexy merged, with its settings flattened to
+// dotted keys. ignored are the top-level keys it wasn't allowed to set.
+type configLayer struct {
+	path    string
+	values  map[string]interface{}
+	ignored []string
+}
+
+// projectKeys are the only keys a project's config file can set unless its
+// directory is trusted. Anything else could point a checkout's users at
+// another issuer, or send their tokens somewhere else.
+var projectKeys = map[string]bool{"profile": true}
+
+// configLayers are the config files dexy merged, lowest precedence first.
+var configLayers []configLayer
+
+// configFiles returns the config files to merge, lowest precedence first:
+// the system's in /etc/dexy and the user's in home, then the project's,
+// found in the working directory and its parents with nearer ones later.
+func configFiles(home string) (base, project []string) {
+	seen := map[string]bool{"": true}
+	for _, f := range []string{findConfigFile("/etc/dexy"), findConfigFile(home)} {
+		if !seen[f] {
+			seen[f] = true
+			base = append(base, f)
+		}
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return base, nil
+	}
+	for {
+		if f := findConfigFile(dir); !seen[f] {
+			seen[f] = true
+			project = append([]string{f}, project...)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return base, project
+}
+
+// trustedProject reports whether the project config file at path is in one
+// of the directories listed in trusted_projects, which only the system and
+// user config files can set.
+func trustedProject(path string) bool {
+	dir := filepath.Dir(path)
+	for _, t := range viper.GetStringSlice("trusted_projects") {
+		t, err := homedir.Expand(t)
+		if err != nil || !filepath.IsAbs(t) {
+			continue
+		}
+		t = filepath.Clean(t)
+		if dir == t || strings.HasPrefix(dir, t+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// findConfigFile returns dir's .dexy config file, in any format viper
+// reads, or "" if it has none.
+func findConfigFile(dir string) string {
+	for _, ext := range viper.SupportedExts {
+		path := filepath.Join(dir, ".dexy."+ext)
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// mergeConfigFile merges path into viper's config, over the files merged
+// before it. If allowed isn't nil, only the top-level keys in it are merged.
+func mergeConfigFile(path string, allowed map[string]bool) error {
+	layer := viper.New()
+	layer.SetConfigFile(path)
+	if err := layer.ReadInConfig(); err != nil {
+		return err
+	}
+
+	settings := layer.AllSettings()
+	var ignored []string
+	for k := range settings {
+		if allowed != nil && !allowed[k] {
+			ignored = append(ignored, k)
+			delete(settings, k)
+		}
+	}
+	sort.Strings(ignored)
+	// Whatever format the file is in, settings are merged as YAML.
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	viper.SetConfigType("yaml")
+	if err := viper.MergeConfig(bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{}
+	for k, v := range settings {
+		flattenConfig(k, v, values)
+	}
+	configLayers = append(configLayers, configLayer{path: path, values: values, ignored: ignored})
+	return nil
+}
+
+// configOrigin returns the config file that set key, or "" if none did.
+func configOrigin(key string) string {
+	key = strings.ToLower(key)
+	for i := len(configLayers) - 1; i >= 0; i-- {
+		if _, ok := configLayers[i].values[key]; ok {
+			return configLayers[i].path
+		}
+	}
+	return ""
+}
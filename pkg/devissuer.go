@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy/dexytest"
+	"github.com/spf13/cobra"
+)
+
+var devIssuerOpts struct {
+	listen             string
+	issuer             string
+	subject            string
+	email              string
+	name               string
+	groups             []string
+	claims             []string
+	password           string
+	clients            []string
+	tokenTTL           time.Duration
+	initialAccessToken string
+}
+
+// devIssuerCmd runs a fake OIDC provider for trying out dexy, and for
+// testing programs that use it, without a real dex.
+var devIssuerCmd = &cobra.Command{
+	Use:   "dev-issuer",
+	Short: "Run a local OIDC provider that approves every login, for testing",
+	Long: `Run a local OIDC provider that approves every login, for testing.
+
+It serves discovery, keys, authorize, token, device, userinfo, revocation and
+client registration endpoints, signing tokens with a key generated at startup. Every login is
+approved straight away as the user given by the flags. Don't expose it to
+anything you don't trust: it hands a token to anyone who asks.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		o := devIssuerOpts
+		issuerURL := o.issuer
+		if issuerURL == "" {
+			issuerURL = "http://" + o.listen
+		}
+		iss, err := dexytest.New(issuerURL)
+		if err != nil {
+			log.Fatalf("error while creating issuer %v", err)
+		}
+		iss.TokenTTL = o.tokenTTL
+		iss.InitialAccessToken = o.initialAccessToken
+		iss.User = dexytest.User{
+			Subject:  o.subject,
+			Email:    o.email,
+			Name:     o.name,
+			Groups:   o.groups,
+			Password: o.password,
+			Claims:   map[string]interface{}{},
+		}
+		for _, c := range o.claims {
+			k, v, err := parseClaim(c)
+			if err != nil {
+				log.Fatalf("error while parsing --claim %v", err)
+			}
+			iss.User.Claims[k] = v
+		}
+		if len(o.clients) > 0 {
+			iss.Clients = map[string]string{}
+			for _, c := range o.clients {
+				parts := strings.SplitN(c, "=", 2)
+				iss.Clients[parts[0]] = ""
+				if len(parts) == 2 {
+					iss.Clients[parts[0]] = parts[1]
+				}
+			}
+		}
+
+		fmt.Printf("Serving %s, add a profile like this to try it:\n\n", iss.URL)
+		fmt.Printf("  dev:\n    dex_host: %s\n    client_id: dexy\n    scopes: [email, groups, offline_access]\n\n", iss.URL)
+		log.Fatal(http.ListenAndServe(o.listen, iss))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(devIssuerCmd)
+	flags := devIssuerCmd.Flags()
+	u := dexytest.DefaultUser
+	flags.StringVar(&devIssuerOpts.listen, "listen", "127.0.0.1:5556", "address to listen on")
+	flags.StringVar(&devIssuerOpts.issuer, "issuer", "", "issuer URL (default is http:// and the listen address)")
+	flags.StringVar(&devIssuerOpts.subject, "subject", u.Subject, "subject of the user logins are approved as")
+	flags.StringVar(&devIssuerOpts.email, "email", u.Email, "email of the user")
+	flags.StringVar(&devIssuerOpts.name, "name", u.Name, "name of the user")
+	flags.StringSliceVar(&devIssuerOpts.groups, "groups", nil, "groups the user is in")
+	flags.StringArrayVar(&devIssuerOpts.claims, "claim", nil, "extra ID token claim as key=value, may be repeated; values that are valid JSON are decoded")
+	flags.StringVar(&devIssuerOpts.password, "password", "", "password the password grant accepts (default is any)")
+	flags.StringArrayVar(&devIssuerOpts.clients, "client", nil, "client as id=secret, or just id for a public client, may be repeated (default is to accept any client)")
+	flags.DurationVar(&devIssuerOpts.tokenTTL, "token-ttl", time.Hour, "how long tokens are valid for")
+	flags.StringVar(&devIssuerOpts.initialAccessToken, "initial-access-token", "", "token needed to register clients (default is to let anyone register)")
+}
+
+// parseClaim splits key=value, decoding the value as JSON if it is valid
+// JSON so that numbers, booleans and lists can be given.
+func parseClaim(s string) (string, interface{}, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, fmt.Errorf("%q is not key=value", s)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(parts[1]), &v); err != nil {
+		return parts[0], parts[1], nil
+	}
+	return parts[0], v, nil
+}
@@ -0,0 +1,117 @@
+package dexy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Claims are the ID token claims dexy knows how to check.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	Groups        []string `json:"groups"`
+	HostedDomain  string   `json:"hd"`
+}
+
+// UnverifiedClaims decodes the payload of a JWT into v without verifying
+// it. That is fine for tokens dexy verified when it got them, and for
+// deciding what to do with a token, but never for trusting one.
+func UnverifiedClaims(tok string, v interface{}) error {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return errors.New("token is not a JWT")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed JWT payload %v", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("malformed JWT claims %v", err)
+	}
+	return nil
+}
+
+// Requirements are claims tokens must have before a Client will cache or
+// return them. They catch logging in as the wrong user up front, rather than
+// as a confusing authorization failure later on.
+type Requirements struct {
+	EmailVerified bool
+	EmailDomains  []string
+	// Groups is satisfied by membership of any one of them.
+	Groups       []string
+	HostedDomain string
+	Issuer       string
+}
+
+func (r Requirements) empty() bool {
+	return !r.EmailVerified && len(r.EmailDomains) == 0 && len(r.Groups) == 0 &&
+		r.HostedDomain == "" && r.Issuer == ""
+}
+
+// Check returns an error describing the first requirement tok doesn't meet.
+func (r Requirements) Check(tok string) error {
+	if r.empty() {
+		return nil
+	}
+	var c Claims
+	if err := UnverifiedClaims(tok, &c); err != nil {
+		return fmt.Errorf("cannot check claim requirements, %v", err)
+	}
+
+	if r.Issuer != "" && c.Issuer != r.Issuer {
+		return fmt.Errorf("issuer %q is not %q", c.Issuer, r.Issuer)
+	}
+	if r.EmailVerified && (c.EmailVerified == nil || !*c.EmailVerified) {
+		return fmt.Errorf("email %q is not verified", c.Email)
+	}
+	if len(r.EmailDomains) > 0 {
+		domain := ""
+		if i := strings.LastIndex(c.Email, "@"); i >= 0 {
+			domain = strings.ToLower(c.Email[i+1:])
+		}
+		if !containsFold(r.EmailDomains, domain) {
+			return fmt.Errorf("email %q is not in an allowed domain %v", c.Email, r.EmailDomains)
+		}
+	}
+	if r.HostedDomain != "" && !strings.EqualFold(c.HostedDomain, r.HostedDomain) {
+		return fmt.Errorf("hosted domain %q is not %q", c.HostedDomain, r.HostedDomain)
+	}
+	if len(r.Groups) > 0 {
+		member := false
+		for _, g := range c.Groups {
+			if contains(r.Groups, g) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return fmt.Errorf("user is not a member of any of the groups %v", r.Groups)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,427 @@
+// Package dexy gets and caches OpenID Connect tokens from dex, or any other
+// provider, the way the dexy command does. Tokens are shared with the dexy
+// command through its cache, so a Go program and dexy can use the same
+// logins.
+//
+//	c, err := dexy.NewClient(dexy.Config{
+//		Name:     "default",
+//		Issuer:   "https://dex.mycompany.com",
+//		ClientID: "dexy",
+//		Cache:    dexy.NewStore(path),
+//	})
+//	...
+//	httpClient := oauth2.NewClient(ctx, c.TokenSource(ctx))
+package dexy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// Grant types a Client can be configured to use.
+const (
+	GrantAuthCode          = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+)
+
+// Config holds everything needed to get a token from a single provider.
+type Config struct {
+	// Name is the key the token is cached under, dexy uses the profile
+	// name.
+	Name string
+
+	Grant        string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// Audiences are other dex clients the ID token should also be issued
+	// for. Audience asks for a token for just one of them, which is cached
+	// separately.
+	Audiences []string
+	Audience  string
+
+	// AuthParams are extra parameters sent with the authorization request,
+	// such as dex's connector_id. ForceLogin skips the cached token and
+	// refresh token, for when the user has asked for a particular kind of
+	// login.
+	AuthParams map[string]string
+	ForceLogin bool
+
+	// PKCE protects authorization codes with a code challenge (RFC 7636),
+	// which providers may require of clients without a secret.
+	PKCE bool
+
+	// MinValidity is how long a cached token must still be valid for to be
+	// used. NonInteractive returns ErrLoginRequired rather than starting a
+	// login that needs the user, for when nobody is there to do it.
+	MinValidity    time.Duration
+	NonInteractive bool
+
+	// Require lists claims tokens must have before they are cached or
+	// returned.
+	Require Requirements
+
+	// Used to authenticate with a signed JWT (RFC 7523) instead of a
+	// client secret.
+	AssertionKeyFile string
+	AssertionKeyID   string
+	AssertionAlg     string
+
+	// Cache is where tokens are kept between runs. If it is nil tokens are
+	// not cached, and every call to Token gets a new one.
+	Cache *Store
+
+	// Login logs the user in for the authorization code grant. It defaults
+	// to BrowserLogin.
+	Login Login
+
+	// OnNewToken, if set, is called with every new token after it has been
+	// cached, but not with tokens that came from the cache.
+	OnNewToken func(*Token)
+}
+
+// Validate checks the config for mistakes the provider would otherwise
+// reject with an unhelpful error.
+func (cfg *Config) Validate() error {
+	switch cfg.Grant {
+	case "", GrantAuthCode, GrantClientCredentials:
+	default:
+		return fmt.Errorf("unsupported grant %q", cfg.Grant)
+	}
+	if cfg.Issuer == "" {
+		return errors.New("no issuer set")
+	}
+	return checkAuthParams(cfg.AuthParams)
+}
+
+// CacheKey is the key the token is stored under in the cache. It ends in
+// the config's Fingerprint, so a name whose issuer, client or grant has
+// changed never gets the old one's tokens, and its refresh token is never
+// sent to another issuer.
+func (cfg *Config) CacheKey() string {
+	key := cfg.Name
+	if cfg.Audience != "" {
+		key += "@" + cfg.Audience
+	}
+	return key + "#" + cfg.Fingerprint()
+}
+
+// Fingerprint identifies the issuer, client ID and grant tokens come from.
+func (cfg *Config) Fingerprint() string {
+	grant := cfg.Grant
+	if grant == "" {
+		grant = GrantAuthCode
+	}
+	h := sha256.Sum256([]byte(strings.TrimSuffix(cfg.Issuer, "/") + "\n" + cfg.ClientID + "\n" + grant))
+	return hex.EncodeToString(h[:4])
+}
+
+// Client gets tokens for a Config. It is safe for concurrent use, and only
+// one login or refresh happens at a time.
+type Client struct {
+	cfg Config
+
+	mu sync.Mutex
+}
+
+// NewClient returns a Client for cfg.
+func NewClient(cfg Config) (*Client, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Grant == "" {
+		cfg.Grant = GrantAuthCode
+	}
+	if cfg.Name == "" {
+		cfg.Name = "default"
+	}
+	if cfg.Login == nil {
+		cfg.Login = BrowserLogin{}
+	}
+	return &Client{cfg: cfg}, nil
+}
+
+// Config returns the client's config.
+func (c *Client) Config() Config {
+	return c.cfg
+}
+
+// ErrLoginRequired is returned instead of starting a login that needs the
+// user, when the config is non-interactive.
+var ErrLoginRequired = errors.New("login required, run dexy to log in")
+
+// Token returns the cached token if it is still valid, otherwise it
+// refreshes it or gets a new one using the configured grant, and caches it.
+func (c *Client) Token(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token(ctx)
+}
+
+// Refresh gets a new token to replace rejected, which a server refused even
+// though it hadn't expired. If the cached token is already a different one,
+// for example because another request refreshed it first, that is returned
+// instead.
+func (c *Client) Refresh(ctx context.Context, rejected *Token) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cfg.Cache != nil && rejected != nil {
+		cached := c.cfg.Cache.Get(c.cfg.CacheKey())
+		if cached.ValidFor(c.cfg.MinValidity) && cached.AccessToken != rejected.AccessToken {
+			return cached, nil
+		}
+	}
+	if err := c.Invalidate(); err != nil {
+		return nil, err
+	}
+	return c.token(ctx)
+}
+
+func (c *Client) token(ctx context.Context) (*Token, error) {
+	var cached *Token
+	if c.cfg.Cache != nil {
+		cached = c.cfg.Cache.Get(c.cfg.CacheKey())
+	}
+	if cached.ValidFor(c.cfg.MinValidity) && !c.cfg.ForceLogin && c.CheckRequirements(cached) == nil {
+		return cached, nil
+	}
+
+	var (
+		tok *Token
+		err error
+	)
+	if cached != nil && cached.RefreshToken != "" && !c.cfg.ForceLogin {
+		// If the refresh fails, for example because the refresh token has
+		// been revoked, fall back to logging in again.
+		tok, err = c.refresh(ctx, cached.RefreshToken)
+		if tok != nil {
+			tok.LoginTime = cached.LoginTime
+		}
+	}
+	if tok == nil {
+		switch {
+		case c.cfg.Grant == GrantClientCredentials:
+			tok, err = c.clientCredentials(ctx)
+		case c.cfg.NonInteractive:
+			err = ErrLoginRequired
+		default:
+			var o *oauth2.Token
+			if o, err = c.cfg.Login.Login(ctx, c); err == nil {
+				tok, err = c.fromOAuth2(ctx, o)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.CheckRequirements(tok); err != nil {
+		return nil, err
+	}
+
+	if c.cfg.Cache != nil {
+		if err := c.cfg.Cache.Put(c.cfg.CacheKey(), tok); err != nil {
+			return nil, fmt.Errorf("error while attempting to write token to file %v", err)
+		}
+	}
+	if c.cfg.OnNewToken != nil {
+		c.cfg.OnNewToken(tok)
+	}
+	return tok, nil
+}
+
+// Invalidate makes the next call to Token get a new token, for when the
+// cached one has been rejected even though it hasn't expired. The refresh
+// token is kept, so this doesn't need a new login.
+func (c *Client) Invalidate() error {
+	if c.cfg.Cache == nil {
+		return nil
+	}
+	return c.cfg.Cache.Invalidate(c.cfg.CacheKey())
+}
+
+// Forget removes every cached token for the config's name.
+func (c *Client) Forget() error {
+	if c.cfg.Cache == nil {
+		return nil
+	}
+	return c.cfg.Cache.Forget(c.cfg.Name)
+}
+
+// CheckRequirements checks tok against the config's requirements, naming
+// the user in the error so it is obvious who logged in.
+func (c *Client) CheckRequirements(tok *Token) error {
+	err := c.cfg.Require.Check(tok.AccessToken)
+	if err == nil {
+		return nil
+	}
+	var claims Claims
+	who := "token"
+	if UnverifiedClaims(tok.AccessToken, &claims) == nil {
+		switch {
+		case claims.Email != "":
+			who = "token for " + claims.Email
+		case claims.Subject != "":
+			who = "token for " + claims.Subject
+		}
+	}
+	return fmt.Errorf("%s does not meet the requirements of profile %q: %v", who, c.cfg.Name, err)
+}
+
+// refresh uses a refresh token to get a new token without the user.
+func (c *Client) refresh(ctx context.Context, refresh string) (*Token, error) {
+	v := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refresh},
+	}
+	o, err := c.RequestToken(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := c.fromOAuth2(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+	// Providers that don't rotate refresh tokens don't send a new one.
+	if tok.RefreshToken == "" {
+		tok.RefreshToken = refresh
+	}
+	return tok, nil
+}
+
+// clientCredentials gets a token for the client itself, with no user
+// involved. This is what CI jobs and service accounts use.
+func (c *Client) clientCredentials(ctx context.Context) (*Token, error) {
+	v := url.Values{
+		"grant_type": {GrantClientCredentials},
+		"scope":      {strings.Join(c.Scopes(), " ")},
+	}
+	o, err := c.RequestToken(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return c.fromOAuth2(ctx, o)
+}
+
+// fromOAuth2 turns a token endpoint response into what dexy hands out. If
+// the provider returned an ID token it is verified and preferred, as that is
+// what dex-backed services expect; otherwise the access token is used.
+func (c *Client) fromOAuth2(ctx context.Context, o *oauth2.Token) (*Token, error) {
+	rawIDToken, ok := o.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return &Token{
+			AccessToken:  o.AccessToken,
+			ExpiryTime:   o.Expiry,
+			RefreshToken: o.RefreshToken,
+		}, nil
+	}
+
+	provider, err := providerFor(c.cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	verifier := provider.Verifier(&oidc.Config{ClientID: c.verifierClientID()})
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("error while verifying id_token %v", err)
+	}
+	return &Token{
+		AccessToken:       rawIDToken,
+		ExpiryTime:        idToken.Expiry,
+		OAuth2AccessToken: o.AccessToken,
+		RefreshToken:      o.RefreshToken,
+	}, nil
+}
+
+// Endpoint returns the provider's OAuth2 endpoints.
+func (c *Client) Endpoint() (oauth2.Endpoint, error) {
+	provider, err := providerFor(c.cfg.Issuer)
+	if err != nil {
+		return oauth2.Endpoint{}, err
+	}
+	return provider.Endpoint(), nil
+}
+
+// crossClientScope asks dex to issue the ID token for another client.
+const crossClientScope = "audience:server:client_id:"
+
+// Scopes returns the scopes to request, always including openid.
+func (c *Client) Scopes() []string {
+	scopes := append([]string{oidc.ScopeOpenID}, c.cfg.Scopes...)
+	for _, aud := range c.audiences() {
+		scopes = append(scopes, crossClientScope+aud)
+	}
+	return scopes
+}
+
+// audiences returns the audiences to request, either the one picked with
+// Audience or every one in Audiences.
+func (c *Client) audiences() []string {
+	if c.cfg.Audience != "" {
+		return []string{c.cfg.Audience}
+	}
+	return c.cfg.Audiences
+}
+
+// verifierClientID is the audience ID tokens are checked against. When dexy
+// asks for a token on behalf of other clients, dex issues it for them rather
+// than for dexy's own client.
+func (c *Client) verifierClientID() string {
+	if auds := c.audiences(); len(auds) > 0 {
+		return auds[0]
+	}
+	return c.cfg.ClientID
+}
+
+// AuthCodeOptions returns the config's extra authorization request
+// parameters as options for AuthCodeURL.
+func (c *Client) AuthCodeOptions() []oauth2.AuthCodeOption {
+	keys := make([]string, 0, len(c.cfg.AuthParams))
+	for k := range c.cfg.AuthParams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	opts := make([]oauth2.AuthCodeOption, 0, len(keys))
+	for _, k := range keys {
+		opts = append(opts, oauth2.SetAuthURLParam(k, c.cfg.AuthParams[k]))
+	}
+	return opts
+}
+
+var validPrompts = map[string]bool{
+	"none":           true,
+	"login":          true,
+	"consent":        true,
+	"select_account": true,
+}
+
+// checkAuthParams catches mistakes in parameters the provider would
+// otherwise reject with an unhelpful error page.
+func checkAuthParams(params map[string]string) error {
+	for _, reserved := range []string{"client_id", "redirect_uri", "response_type", "scope", "state"} {
+		if _, ok := params[reserved]; ok {
+			return fmt.Errorf("auth param %q is set by dexy and can't be overridden", reserved)
+		}
+	}
+	if prompt, ok := params["prompt"]; ok {
+		for _, v := range strings.Fields(prompt) {
+			if !validPrompts[v] {
+				return fmt.Errorf("invalid prompt %q, must be one of none, login, consent or select_account", v)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package dexy_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/chronojam/dexy/pkg/dexy/dexytest"
+	"golang.org/x/oauth2"
+)
+
+// newClient returns a client of iss caching its tokens in a temporary
+// directory.
+func newClient(t *testing.T, iss *dexytest.Issuer, cfg dexy.Config) *dexy.Client {
+	t.Helper()
+	cfg.Issuer = iss.URL
+	if cfg.ClientID == "" {
+		cfg.ClientID = "dexy"
+	}
+	if cfg.Cache == nil {
+		cfg.Cache = dexy.NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	}
+	c, err := dexy.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+var codeRe = regexp.MustCompile(`Copy this code back to dexy: (\S+)`)
+
+// pasteLogin logs in by fetching the login page and pasting the code it
+// shows, recording the login page's URL.
+func pasteLogin(t *testing.T, authURL *string) dexy.PasteLogin {
+	return dexy.PasteLogin{Prompt: func(u string) (string, error) {
+		if authURL != nil {
+			*authURL = u
+		}
+		resp, err := http.Get(u)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		m := codeRe.FindSubmatch(b)
+		if m == nil {
+			return "", errors.New("no code in " + string(b))
+		}
+		return string(m[1]), nil
+	}}
+}
+
+// failLogin fails the test if a login is started.
+type failLogin struct{ t *testing.T }
+
+func (l failLogin) Login(ctx context.Context, c *dexy.Client) (*oauth2.Token, error) {
+	l.t.Error("unexpected login")
+	return nil, errors.New("unexpected login")
+}
+
+func checkEmail(t *testing.T, tok *dexy.Token, want string) {
+	t.Helper()
+	var c dexy.Claims
+	if err := dexy.UnverifiedClaims(tok.AccessToken, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Email != want {
+		t.Errorf("email = %q, want %q", c.Email, want)
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestBrowserLoginPKCE(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+
+	var authURL string
+	c := newClient(t, iss, dexy.Config{
+		PKCE: true,
+		Login: dexy.BrowserLogin{
+			Port: freePort(t),
+			OpenURL: func(u string) error {
+				authURL = u
+				// The provider redirects straight back to the callback.
+				go http.Get(u)
+				return nil
+			},
+		},
+	})
+	tok, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmail(t, tok, iss.User.Email)
+	if tok.LoginTime == nil {
+		t.Error("token has no login time")
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("login page %s has no S256 code challenge", authURL)
+	}
+	if !strings.HasPrefix(q.Get("redirect_uri"), "http://localhost:") {
+		t.Errorf("redirect_uri = %q, want a localhost one", q.Get("redirect_uri"))
+	}
+
+	// The second call is served from the cache.
+	c = newClient(t, iss, dexy.Config{Cache: c.Config().Cache, Login: failLogin{t}})
+	cached, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.AccessToken != tok.AccessToken {
+		t.Error("cached token wasn't used")
+	}
+}
+
+func TestPKCEWrongVerifier(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+	c := newClient(t, iss, dexy.Config{PKCE: true})
+
+	verifier, err := c.CodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := c.AuthCodeURL(dexy.OOBRedirectURL, "state", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := pasteLogin(t, nil).Prompt(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := c.CodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ExchangeCode(context.Background(), code, dexy.OOBRedirectURL, other); err == nil {
+		t.Error("code was exchanged with the wrong verifier")
+	}
+}
+
+func TestPasteLogin(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+
+	var authURL string
+	c := newClient(t, iss, dexy.Config{Login: pasteLogin(t, &authURL)})
+	tok, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmail(t, tok, iss.User.Email)
+	if strings.Contains(authURL, "code_challenge") {
+		t.Errorf("login page %s has a code challenge without PKCE", authURL)
+	}
+}
+
+func TestDeviceLogin(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+
+	c := newClient(t, iss, dexy.Config{Login: dexy.DeviceLogin{
+		Prompt: func(verificationURI, userCode, verificationURIComplete string) {
+			if userCode == "" {
+				t.Error("no user code")
+			}
+			resp, err := http.Get(verificationURIComplete)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		},
+	}})
+	tok, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmail(t, tok, iss.User.Email)
+}
+
+func TestRefresh(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+
+	c := newClient(t, iss, dexy.Config{
+		Scopes: []string{"openid", "email", "offline_access"},
+		Login:  pasteLogin(t, nil),
+	})
+	ctx := context.Background()
+	first, err := c.Token(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.RefreshToken == "" {
+		t.Fatal("no refresh token with offline_access")
+	}
+
+	// From here on every token has to come from the refresh token.
+	c = newClient(t, iss, dexy.Config{
+		Scopes: c.Config().Scopes,
+		Cache:  c.Config().Cache,
+		Login:  failLogin{t},
+	})
+	second, err := c.Refresh(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ID tokens issued within the same second can be identical, the
+	// rotated refresh token shows a refresh happened.
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("Refresh didn't refresh")
+	}
+	if second.LoginTime == nil || !second.LoginTime.Equal(*first.LoginTime) {
+		t.Errorf("login time %v, want %v from the login", second.LoginTime, first.LoginTime)
+	}
+	checkEmail(t, second, iss.User.Email)
+
+	// Asking for more validity than the token has left refreshes it too.
+	c = newClient(t, iss, dexy.Config{
+		Scopes:      c.Config().Scopes,
+		Cache:       c.Config().Cache,
+		Login:       failLogin{t},
+		MinValidity: 2 * time.Hour,
+	})
+	third, err := c.Token(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.RefreshToken == second.RefreshToken {
+		t.Error("token wasn't refreshed for MinValidity")
+	}
+}
+
+func TestNonInteractive(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+
+	c := newClient(t, iss, dexy.Config{NonInteractive: true, Login: failLogin{t}})
+	if _, err := c.Token(context.Background()); err != dexy.ErrLoginRequired {
+		t.Errorf("err = %v, want ErrLoginRequired", err)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+	iss.Clients = map[string]string{"ci": "s3cret"}
+
+	c := newClient(t, iss, dexy.Config{
+		Grant:        dexy.GrantClientCredentials,
+		ClientID:     "ci",
+		ClientSecret: "s3cret",
+		Login:        failLogin{t},
+	})
+	tok, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tok.Valid() {
+		t.Error("token isn't valid")
+	}
+
+	c = newClient(t, iss, dexy.Config{
+		Grant:        dexy.GrantClientCredentials,
+		ClientID:     "ci",
+		ClientSecret: "wrong",
+	})
+	if _, err := c.Token(context.Background()); err == nil {
+		t.Error("got a token with the wrong secret")
+	}
+}
+
+func TestPasswordLogin(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+	iss.User.Password = "hunter2"
+
+	login := func(password string) dexy.PasswordLogin {
+		return dexy.PasswordLogin{Credentials: func() (string, string, error) {
+			return iss.User.Email, password, nil
+		}}
+	}
+	c := newClient(t, iss, dexy.Config{Login: login("hunter2")})
+	tok, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmail(t, tok, iss.User.Email)
+
+	c = newClient(t, iss, dexy.Config{Login: login("wrong")})
+	if _, err := c.Token(context.Background()); err == nil {
+		t.Error("logged in with the wrong password")
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+
+	subject, err := iss.IDToken("dexy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(t, iss, dexy.Config{})
+	o, err := c.RequestToken(context.Background(), url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {subject},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:id_token"},
+		"audience":           {"other"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Audience interface{} `json:"aud"`
+		Email    string      `json:"email"`
+	}
+	if err := dexy.UnverifiedClaims(o.AccessToken, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fmtAudience(claims.Audience), "other") {
+		t.Errorf("aud = %v, want it to include other", claims.Audience)
+	}
+	if claims.Email != iss.User.Email {
+		t.Errorf("email = %q, want %q", claims.Email, iss.User.Email)
+	}
+
+	_, err = c.RequestToken(context.Background(), url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {"not a token"},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:id_token"},
+	})
+	if re, ok := err.(*dexy.RequestError); !ok || re.Code != "invalid_request" {
+		t.Errorf("err = %v, want an invalid_request RequestError", err)
+	}
+}
+
+// fmtAudience joins an aud claim, which is a string or a list of them.
+func fmtAudience(aud interface{}) string {
+	switch a := aud.(type) {
+	case string:
+		return a
+	case []interface{}:
+		var s []string
+		for _, v := range a {
+			s = append(s, v.(string))
+		}
+		return strings.Join(s, " ")
+	}
+	return ""
+}
+
+func TestCacheIsPerIssuerAndClient(t *testing.T) {
+	first := dexytest.NewServer()
+	defer first.Close()
+	second := dexytest.NewServer()
+	defer second.Close()
+	second.Clients = map[string]string{"dexy": "", "other": "", "ci": "s3cret"}
+
+	cache := dexy.NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	scopes := []string{"openid", "email", "offline_access"}
+	c := newClient(t, first, dexy.Config{Cache: cache, Scopes: scopes, Login: pasteLogin(t, nil)})
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same name pointed at another issuer, client or grant has to get
+	// its own token, and never sends the first issuer's refresh token.
+	for _, cfg := range []dexy.Config{
+		{Scopes: scopes, Login: pasteLogin(t, nil)},
+		{ClientID: "other", Scopes: scopes, Login: pasteLogin(t, nil)},
+		{Grant: dexy.GrantClientCredentials, ClientID: "ci", ClientSecret: "s3cret"},
+	} {
+		cfg.Cache = cache
+		c := newClient(t, second, cfg)
+		tok, err := c.Token(context.Background())
+		if err != nil {
+			t.Fatalf("%s/%s: %v", cfg.ClientID, cfg.Grant, err)
+		}
+		var claims dexy.Claims
+		if err := dexy.UnverifiedClaims(tok.AccessToken, &claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims.Issuer != second.URL {
+			t.Errorf("%s/%s: got a token from %s, want one from %s", cfg.ClientID, cfg.Grant, claims.Issuer, second.URL)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+// Package dexytest runs a fake OpenID Connect provider, for testing dexy and
+// the programs that use it without a real dex.
+//
+// The Issuer approves every login straight away as its configured User, and
+// supports the authorization code, refresh token, device code, client
+// credentials, password and token exchange grants, dynamic client
+// registration and WebFinger issuer discovery:
+//
+//	iss := dexytest.NewServer()
+//	defer iss.Close()
+//	iss.User.Groups = []string{"admins"}
+//
+//	c, err := dexy.NewClient(dexy.Config{
+//		Issuer:   iss.URL,
+//		ClientID: "test",
+//		Login:    dexy.DeviceLogin{},
+//	})
+package dexytest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// User is who every login is approved as.
+type User struct {
+	Subject string
+	Email   string
+	Name    string
+	Groups  []string
+	// Password is what the password grant accepts. If it is empty any
+	// password is accepted.
+	Password string
+	// Claims are added to ID tokens, overriding the ones above.
+	Claims map[string]interface{}
+}
+
+// DefaultUser is the User of a new Issuer.
+var DefaultUser = User{
+	Subject: "CgR0ZXN0EgVsb2NhbA",
+	Email:   "test@example.com",
+	Name:    "Test User",
+}
+
+// Issuer is a fake OpenID Connect provider. It is an http.Handler, serving
+// its endpoints under the path of URL.
+type Issuer struct {
+	// URL is the issuer URL tokens are issued under, with no trailing slash.
+	URL  string
+	User User
+	// Clients maps client IDs to their secrets. A client with an empty
+	// secret is public. If Clients is nil any client is accepted, with any
+	// secret.
+	Clients map[string]string
+	// TokenTTL is how long tokens are valid for, an hour if zero.
+	TokenTTL time.Duration
+	// InitialAccessToken, if set, is needed to register clients.
+	InitialAccessToken string
+
+	key    *rsa.PrivateKey
+	keyID  string
+	server *httptest.Server
+
+	mu            sync.Mutex
+	codes         map[string]*grant
+	devices       map[string]*grant
+	accessTokens  map[string]*grant
+	refreshTokens map[string]*grant
+	registrations map[string]*registration
+}
+
+// grant is what a code, device code or token was issued for.
+type grant struct {
+	clientID    string
+	scopes      []string
+	audiences   []string
+	nonce       string
+	redirectURI string
+	userCode    string
+	// challenge and challengeMethod are the authorization request's PKCE
+	// code challenge.
+	challenge       string
+	challengeMethod string
+	// user is whether the grant is for the User, rather than for the
+	// client itself.
+	user     bool
+	approved bool
+	expiry   time.Time
+}
+
+// New returns an Issuer for issuerURL with a freshly generated signing key.
+// Serve it at that URL with net/http.
+func New(issuerURL string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		URL:           strings.TrimSuffix(issuerURL, "/"),
+		User:          DefaultUser,
+		key:           key,
+		keyID:         kid,
+		codes:         map[string]*grant{},
+		devices:       map[string]*grant{},
+		accessTokens:  map[string]*grant{},
+		refreshTokens: map[string]*grant{},
+		registrations: map[string]*registration{},
+	}, nil
+}
+
+// NewServer starts an Issuer on a local port, like httptest.NewServer.
+// Call Close when done with it.
+func NewServer() *Issuer {
+	i, err := New("")
+	if err != nil {
+		panic(fmt.Sprintf("dexytest: %v", err))
+	}
+	i.server = httptest.NewServer(i)
+	i.URL = i.server.URL
+	return i
+}
+
+// Close shuts down a server started with NewServer.
+func (i *Issuer) Close() {
+	if i.server != nil {
+		i.server.Close()
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (i *Issuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := ""
+	if u, err := url.Parse(i.URL); err == nil {
+		prefix = strings.TrimSuffix(u.Path, "/")
+	}
+	if r.URL.Path == "/.well-known/webfinger" {
+		i.webfinger(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, prefix) {
+	case "/.well-known/openid-configuration":
+		i.discovery(w, r)
+	case "/keys":
+		writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &i.key.PublicKey,
+			KeyID:     i.keyID,
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}})
+	case "/auth":
+		i.authorize(w, r)
+	case "/token":
+		i.token(w, r)
+	case "/device/code":
+		i.deviceCode(w, r)
+	case "/device":
+		i.device(w, r)
+	case "/userinfo":
+		i.userinfo(w, r)
+	case "/token/revoke":
+		i.revoke(w, r)
+	case "/register":
+		i.register(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/auth",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/keys",
+		"userinfo_endpoint":                     i.URL + "/userinfo",
+		"revocation_endpoint":                   i.URL + "/token/revoke",
+		"device_authorization_endpoint":         i.URL + "/device/code",
+		"registration_endpoint":                 i.URL + "/register",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{string(jose.RS256)},
+		"scopes_supported":                      []string{"openid", "email", "groups", "profile", "offline_access"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "private_key_jwt"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"grant_types_supported": []string{
+			grantAuthCode, grantRefreshToken, grantDeviceCode,
+			grantClientCredentials, grantPassword, grantTokenExchange,
+		},
+		"claims_supported": []string{"iss", "sub", "aud", "exp", "iat", "azp", "nonce", "email", "email_verified", "name", "groups"},
+	})
+}
+
+// webfinger answers OpenID Connect discovery for any account with this
+// issuer.
+func (i *Issuer) webfinger(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	if resource == "" {
+		http.Error(w, "missing resource", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subject": resource,
+		"links": []map[string]string{
+			{"rel": "http://openid.net/specs/connect/1.0/issuer", "href": i.URL},
+		},
+	})
+}
+
+// authorize approves the login straight away and sends the user back with
+// a code. With the out-of-band redirect URI the code is shown instead.
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI := q.Get("redirect_uri")
+	if !i.knownClient(q.Get("client_id")) {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if redirectURI == "" {
+		http.Error(w, "missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" {
+		redirectWith(w, r, redirectURI, url.Values{
+			"error": {"unsupported_response_type"},
+			"state": {q.Get("state")},
+		})
+		return
+	}
+	method := q.Get("code_challenge_method")
+	if q.Get("code_challenge") != "" && method == "" {
+		method = "plain"
+	}
+	if method != "" && method != "S256" && method != "plain" {
+		redirectWith(w, r, redirectURI, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {"unsupported code_challenge_method"},
+			"state":             {q.Get("state")},
+		})
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scopes := strings.Fields(q.Get("scope"))
+	i.mu.Lock()
+	i.codes[code] = &grant{
+		clientID:        q.Get("client_id"),
+		user:            true,
+		scopes:          scopes,
+		audiences:       crossClientAudiences(scopes),
+		nonce:           q.Get("nonce"),
+		redirectURI:     redirectURI,
+		challenge:       q.Get("code_challenge"),
+		challengeMethod: method,
+		expiry:          time.Now().Add(10 * time.Minute),
+	}
+	i.mu.Unlock()
+
+	if redirectURI == oobRedirectURI {
+		fmt.Fprintf(w, "Copy this code back to dexy: %s\n", code)
+		return
+	}
+	redirectWith(w, r, redirectURI, url.Values{"code": {code}, "state": {q.Get("state")}})
+}
+
+// deviceCode starts a device login (RFC 8628). It is approved once the
+// verification page is visited, or otherwise on the second poll, so clients
+// see one authorization_pending.
+func (i *Issuer) deviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	clientID, ok := i.authenticate(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	deviceCode, err := randomString()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	userCode := strings.ToUpper(deviceCode[:4] + "-" + deviceCode[4:8])
+	scopes := strings.Fields(r.Form.Get("scope"))
+	i.mu.Lock()
+	i.devices[deviceCode] = &grant{
+		clientID:  clientID,
+		user:      true,
+		scopes:    scopes,
+		audiences: crossClientAudiences(scopes),
+		userCode:  userCode,
+		expiry:    time.Now().Add(5 * time.Minute),
+	}
+	i.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          i.URL + "/device",
+		"verification_uri_complete": i.URL + "/device?user_code=" + userCode,
+		"expires_in":                300,
+		"interval":                  1,
+	})
+}
+
+// device is the verification page, which approves the user code it is
+// given.
+func (i *Issuer) device(w http.ResponseWriter, r *http.Request) {
+	userCode := r.URL.Query().Get("user_code")
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, g := range i.devices {
+		if userCode != "" && g.userCode == userCode {
+			g.approved = true
+			fmt.Fprintf(w, "Approved %s, you can close this window\n", userCode)
+			return
+		}
+	}
+	http.Error(w, "unknown user_code", http.StatusNotFound)
+}
+
+func (i *Issuer) userinfo(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "invalid_token", "missing bearer token")
+		return
+	}
+	i.mu.Lock()
+	g := i.accessTokens[strings.TrimPrefix(auth, "Bearer ")]
+	i.mu.Unlock()
+	if g == nil || time.Now().After(g.expiry) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "invalid_token", "unknown or expired access token")
+		return
+	}
+	writeJSON(w, http.StatusOK, i.claims(g))
+}
+
+// revoke forgets an access or refresh token (RFC 7009). Unknown tokens are
+// not an error.
+func (i *Issuer) revoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	clientID, ok := i.authenticate(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	token := r.Form.Get("token")
+	i.mu.Lock()
+	for _, m := range []map[string]*grant{i.accessTokens, i.refreshTokens} {
+		if g := m[token]; g != nil && g.clientID == clientID {
+			delete(m, token)
+		}
+	}
+	i.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// knownClient reports whether clientID is one of Clients.
+func (i *Issuer) knownClient(clientID string) bool {
+	_, ok := i.clientSecret(clientID)
+	return ok
+}
+
+// clientSecret returns the secret of a known client. Any client is known,
+// with any secret, when Clients is nil.
+func (i *Issuer) clientSecret(clientID string) (secret string, ok bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.Clients == nil {
+		return "", clientID != ""
+	}
+	secret, ok = i.Clients[clientID]
+	return secret, ok
+}
+
+// authenticate returns the client making a token endpoint request. Clients
+// may use basic auth, form parameters or a client assertion; assertions are
+// trusted without checking their signature.
+func (i *Issuer) authenticate(r *http.Request) (string, bool) {
+	if assertion := r.Form.Get("client_assertion"); assertion != "" {
+		var c dexy.Claims
+		if err := dexy.UnverifiedClaims(assertion, &c); err != nil {
+			return "", false
+		}
+		return c.Issuer, i.knownClient(c.Issuer)
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+	}
+	want, ok := i.clientSecret(clientID)
+	if !ok {
+		return "", false
+	}
+	return clientID, i.Clients == nil || want == secret
+}
+
+func (i *Issuer) ttl() time.Duration {
+	if i.TokenTTL > 0 {
+		return i.TokenTTL
+	}
+	return time.Hour
+}
+
+// claims are what ID tokens and userinfo say about who g is for: the User,
+// or the client itself when no user is involved.
+func (i *Issuer) claims(g *grant) map[string]interface{} {
+	if !g.user {
+		return map[string]interface{}{"sub": g.clientID}
+	}
+	u := i.User
+	claims := map[string]interface{}{"sub": u.Subject}
+	if u.Email != "" {
+		claims["email"] = u.Email
+		claims["email_verified"] = true
+	}
+	if u.Name != "" {
+		claims["name"] = u.Name
+	}
+	if len(u.Groups) > 0 {
+		claims["groups"] = u.Groups
+	}
+	for k, v := range u.Claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+// IDToken signs an ID token for the User, issued to clientID for the given
+// audiences, or for clientID itself if there are none. It is for tests that
+// need a token without logging in.
+func (i *Issuer) IDToken(clientID string, audiences ...string) (string, error) {
+	return i.sign(i.claims(&grant{user: true}), clientID, audiences, "")
+}
+
+func (i *Issuer) sign(claims map[string]interface{}, clientID string, audiences []string, nonce string) (string, error) {
+	now := time.Now()
+	claims["iss"] = i.URL
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(i.ttl()).Unix()
+	switch len(audiences) {
+	case 0:
+		claims["aud"] = clientID
+	case 1:
+		claims["aud"] = audiences[0]
+	default:
+		claims["aud"] = audiences
+	}
+	if len(audiences) > 0 {
+		claims["azp"] = clientID
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: i.key, KeyID: i.keyID},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// oobRedirectURI is the out-of-band redirect URI, for pasting codes by hand.
+const oobRedirectURI = "urn:ietf:wg:oauth:2.0:oob"
+
+// crossClientScope is dex's scope for asking for a token for another client.
+const crossClientScope = "audience:server:client_id:"
+
+func crossClientAudiences(scopes []string) []string {
+	var auds []string
+	for _, s := range scopes {
+		if strings.HasPrefix(s, crossClientScope) {
+			auds = append(auds, strings.TrimPrefix(s, crossClientScope))
+		}
+	}
+	return auds
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func redirectWith(w http.ResponseWriter, r *http.Request, redirectURI string, v url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	q := u.Query()
+	for k, vals := range v {
+		q[k] = vals
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
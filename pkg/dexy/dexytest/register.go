@@ -0,0 +1,120 @@
+package dexytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// registration is a client registered dynamically, and the token that
+// manages it.
+type registration struct {
+	metadata    map[string]interface{}
+	secret      string
+	accessToken string
+}
+
+// register is the dynamic client registration endpoint (RFC 7591). POST to
+// it registers a client; GET, PUT and DELETE with ?client_id= and the
+// registration access token manage one (RFC 7592).
+func (i *Issuer) register(w http.ResponseWriter, r *http.Request) {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if r.Method == http.MethodPost {
+		if i.InitialAccessToken != "" && bearer != i.InitialAccessToken {
+			writeError(w, http.StatusUnauthorized, "invalid_token", "initial access token required")
+			return
+		}
+		i.updateRegistration(w, r, "")
+		return
+	}
+
+	clientID := r.URL.Query().Get("client_id")
+	i.mu.Lock()
+	reg := i.registrations[clientID]
+	i.mu.Unlock()
+	if reg == nil || bearer != reg.accessToken {
+		writeError(w, http.StatusUnauthorized, "invalid_token", "unknown client or wrong registration access token")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		i.mu.Lock()
+		resp := i.registrationResponse(clientID, reg)
+		i.mu.Unlock()
+		writeJSON(w, http.StatusOK, resp)
+	case http.MethodPut:
+		i.updateRegistration(w, r, clientID)
+	case http.MethodDelete:
+		i.mu.Lock()
+		delete(i.registrations, clientID)
+		if i.Clients != nil {
+			delete(i.Clients, clientID)
+		}
+		i.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// updateRegistration registers a new client, or replaces the metadata of
+// clientID.
+func (i *Issuer) updateRegistration(w http.ResponseWriter, r *http.Request, clientID string) {
+	var metadata map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_client_metadata", "body is not a JSON object")
+		return
+	}
+	if uris, _ := metadata["redirect_uris"].([]interface{}); len(uris) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_redirect_uri", "no redirect_uris")
+		return
+	}
+	if clientID != "" && metadata["client_id"] != clientID {
+		writeError(w, http.StatusBadRequest, "invalid_client_metadata", "client_id does not match")
+		return
+	}
+	for _, k := range []string{"client_id", "client_secret", "registration_access_token", "registration_client_uri"} {
+		delete(metadata, k)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	reg := i.registrations[clientID]
+	status := http.StatusOK
+	if reg == nil {
+		var err error
+		reg = &registration{}
+		if clientID, err = randomString(); err == nil {
+			reg.accessToken, err = randomString()
+		}
+		if err == nil && metadata["token_endpoint_auth_method"] != "none" {
+			reg.secret, err = randomString()
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		i.registrations[clientID] = reg
+		if i.Clients != nil {
+			i.Clients[clientID] = reg.secret
+		}
+		status = http.StatusCreated
+	}
+	reg.metadata = metadata
+	writeJSON(w, status, i.registrationResponse(clientID, reg))
+}
+
+func (i *Issuer) registrationResponse(clientID string, reg *registration) map[string]interface{} {
+	resp := map[string]interface{}{}
+	for k, v := range reg.metadata {
+		resp[k] = v
+	}
+	resp["client_id"] = clientID
+	resp["registration_access_token"] = reg.accessToken
+	resp["registration_client_uri"] = i.URL + "/register?client_id=" + clientID
+	if reg.secret != "" {
+		resp["client_secret"] = reg.secret
+		resp["client_secret_expires_at"] = 0
+	}
+	return resp
+}
@@ -0,0 +1,227 @@
+package dexytest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	grantAuthCode          = "authorization_code"
+	grantRefreshToken      = "refresh_token"
+	grantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	grantClientCredentials = "client_credentials"
+	grantPassword          = "password"
+	grantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	tokenTypeIDToken     = "urn:ietf:params:oauth:token-type:id_token"
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// token is the token endpoint.
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	clientID, ok := i.authenticate(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+
+	switch r.Form.Get("grant_type") {
+	case grantAuthCode:
+		i.mu.Lock()
+		g := i.codes[r.Form.Get("code")]
+		delete(i.codes, r.Form.Get("code"))
+		i.mu.Unlock()
+		switch {
+		case g == nil || time.Now().After(g.expiry) || g.clientID != clientID:
+			writeError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		case g.redirectURI != r.Form.Get("redirect_uri"):
+			writeError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+		case !g.verify(r.Form.Get("code_verifier")):
+			writeError(w, http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge")
+		default:
+			i.issue(w, g)
+		}
+
+	case grantRefreshToken:
+		i.mu.Lock()
+		g := i.refreshTokens[r.Form.Get("refresh_token")]
+		delete(i.refreshTokens, r.Form.Get("refresh_token"))
+		i.mu.Unlock()
+		if g == nil || g.clientID != clientID {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "unknown refresh token")
+			return
+		}
+		i.issue(w, g)
+
+	case grantDeviceCode:
+		i.mu.Lock()
+		g := i.devices[r.Form.Get("device_code")]
+		pending := g != nil && !g.approved
+		if pending {
+			g.approved = true
+		} else {
+			delete(i.devices, r.Form.Get("device_code"))
+		}
+		i.mu.Unlock()
+		switch {
+		case g == nil || g.clientID != clientID:
+			writeError(w, http.StatusBadRequest, "invalid_grant", "unknown device code")
+		case time.Now().After(g.expiry):
+			writeError(w, http.StatusBadRequest, "expired_token", "device code has expired")
+		case pending:
+			writeError(w, http.StatusBadRequest, "authorization_pending", "")
+		default:
+			i.issue(w, g)
+		}
+
+	case grantPassword:
+		if i.User.Password != "" && r.Form.Get("password") != i.User.Password {
+			writeError(w, http.StatusUnauthorized, "invalid_grant", "wrong username or password")
+			return
+		}
+		scopes := strings.Fields(r.Form.Get("scope"))
+		i.issue(w, &grant{clientID: clientID, user: true, scopes: scopes, audiences: crossClientAudiences(scopes)})
+
+	case grantClientCredentials:
+		scopes := strings.Fields(r.Form.Get("scope"))
+		i.issue(w, &grant{clientID: clientID, scopes: scopes, audiences: crossClientAudiences(scopes)})
+
+	case grantTokenExchange:
+		i.exchange(w, r, clientID)
+
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// issue writes a token response for g. Refresh tokens are only handed out
+// with the offline_access scope, as dex does.
+func (i *Issuer) issue(w http.ResponseWriter, g *grant) {
+	idToken, err := i.sign(i.claims(g), g.clientID, g.audiences, g.nonce)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken, err := randomString()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	resp := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "bearer",
+		"expires_in":   int(i.ttl().Seconds()),
+		"id_token":     idToken,
+	}
+
+	next := &grant{clientID: g.clientID, user: g.user, scopes: g.scopes, audiences: g.audiences, expiry: time.Now().Add(i.ttl())}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.accessTokens[accessToken] = next
+	if g.user && hasScope(g.scopes, "offline_access") {
+		refreshToken, err := randomString()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		i.refreshTokens[refreshToken] = next
+		resp["refresh_token"] = refreshToken
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// exchange swaps an ID token this issuer signed, or one of its access
+// tokens, for a token for the requested audiences (RFC 8693).
+func (i *Issuer) exchange(w http.ResponseWriter, r *http.Request, clientID string) {
+	subject := r.Form.Get("subject_token")
+	g := &grant{
+		clientID:  clientID,
+		scopes:    strings.Fields(r.Form.Get("scope")),
+		audiences: r.Form["audience"],
+		expiry:    time.Now().Add(i.ttl()),
+	}
+	switch r.Form.Get("subject_token_type") {
+	case tokenTypeIDToken:
+		tok, err := jwt.ParseSigned(subject)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "subject_token is not a JWT")
+			return
+		}
+		var c jwt.Claims
+		if err := tok.Claims(&i.key.PublicKey, &c); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "subject_token was not signed by this issuer")
+			return
+		}
+		if err := c.Validate(jwt.Expected{Issuer: i.URL, Time: time.Now()}); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "subject_token "+err.Error())
+			return
+		}
+		g.user = c.Subject == i.User.Subject
+	case tokenTypeAccessToken:
+		i.mu.Lock()
+		sg := i.accessTokens[subject]
+		i.mu.Unlock()
+		if sg == nil || time.Now().After(sg.expiry) {
+			writeError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired subject_token")
+			return
+		}
+		g.user = sg.user
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_request", "unsupported subject_token_type")
+		return
+	}
+
+	requested := r.Form.Get("requested_token_type")
+	if requested == "" {
+		requested = tokenTypeIDToken
+	}
+	var token string
+	var err error
+	switch requested {
+	case tokenTypeIDToken:
+		token, err = i.sign(i.claims(g), clientID, g.audiences, "")
+	case tokenTypeAccessToken:
+		token, err = randomString()
+		if err == nil {
+			i.mu.Lock()
+			i.accessTokens[token] = g
+			i.mu.Unlock()
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_request", "unsupported requested_token_type")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":      token,
+		"issued_token_type": requested,
+		"token_type":        "N_A",
+		"expires_in":        int(i.ttl().Seconds()),
+	})
+}
+
+// verify checks a PKCE code verifier against the grant's code challenge.
+// Grants without a challenge accept no verifier.
+func (g *grant) verify(verifier string) bool {
+	switch g.challengeMethod {
+	case "":
+		return verifier == ""
+	case "S256":
+		sum := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(sum[:]) == g.challenge
+	}
+	return verifier == g.challenge
+}
@@ -0,0 +1,107 @@
+// Package grpcdexy authenticates gRPC calls with dexy tokens. It is kept
+// apart from package dexy so programs that don't use gRPC don't have to
+// build it:
+//
+//	conn, err := grpc.Dial(addr, append(grpcdexy.DialOptions(c),
+//		grpc.WithTransportCredentials(credentials.NewTLS(nil)))...)
+package grpcdexy
+
+import (
+	"context"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DialOptions returns the options that add src's token to every call on a
+// connection and retry calls the server rejects as Unauthenticated.
+func DialOptions(src dexy.Source) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithPerRPCCredentials(&dexy.RPCCredentials{Source: src}),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor(src)),
+		grpc.WithStreamInterceptor(StreamClientInterceptor(src)),
+	}
+}
+
+// UnaryClientInterceptor retries a call that fails with Unauthenticated
+// once, after refreshing src's token. The token itself is added by
+// dexy.RPCCredentials.
+func UnaryClientInterceptor(src dexy.Source) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		tok, err := src.Token(ctx)
+		if err != nil {
+			return err
+		}
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		if !Unauthenticated(err) {
+			return err
+		}
+		if _, refreshErr := src.Refresh(ctx, tok); refreshErr != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor retries opening a stream that fails with
+// Unauthenticated once, after refreshing src's token. A stream the server
+// rejects later can't be replayed, so then the token is only refreshed for
+// the streams and calls after it.
+func StreamClientInterceptor(src dexy.Source) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		tok, err := src.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s, err := streamer(ctx, desc, cc, method, opts...)
+		if Unauthenticated(err) {
+			if tok, err = src.Refresh(ctx, tok); err != nil {
+				return nil, err
+			}
+			s, err = streamer(ctx, desc, cc, method, opts...)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &stream{ClientStream: s, ctx: ctx, src: src, tok: tok}, nil
+	}
+}
+
+// stream refreshes the token the first time the server rejects it.
+type stream struct {
+	grpc.ClientStream
+	ctx       context.Context
+	src       dexy.Source
+	tok       *dexy.Token
+	refreshed bool
+}
+
+func (s *stream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if !s.refreshed && Unauthenticated(err) {
+		s.refreshed = true
+		s.src.Refresh(s.ctx, s.tok)
+	}
+	return err
+}
+
+// Unauthenticated reports whether err, or an error it wraps, is a gRPC
+// status with the Unauthenticated code.
+func Unauthenticated(err error) bool {
+	for err != nil {
+		if s, ok := status.FromError(err); ok {
+			return s.Code() == codes.Unauthenticated
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			return false
+		}
+	}
+	return false
+}
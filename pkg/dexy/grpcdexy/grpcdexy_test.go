@@ -0,0 +1,170 @@
+package grpcdexy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/chronojam/dexy/pkg/dexy/grpcdexy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeSource hands out "old" until it is refreshed, then "new".
+type fakeSource struct {
+	mu        sync.Mutex
+	current   string
+	refreshes int
+}
+
+func (s *fakeSource) Token(ctx context.Context) (*dexy.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == "" {
+		s.current = "old"
+	}
+	return &dexy.Token{AccessToken: s.current, ExpiryTime: time.Now().Add(time.Hour)}, nil
+}
+
+func (s *fakeSource) Refresh(ctx context.Context, rejected *dexy.Token) (*dexy.Token, error) {
+	s.mu.Lock()
+	s.refreshes++
+	s.current = "new"
+	s.mu.Unlock()
+	return s.Token(ctx)
+}
+
+// wrapped wraps an error the way fmt.Errorf's %w does.
+type wrapped struct{ err error }
+
+func (w wrapped) Error() string { return "wrapped: " + w.err.Error() }
+func (w wrapped) Unwrap() error { return w.err }
+
+// caused wraps an error the way github.com/pkg/errors does.
+type caused struct{ err error }
+
+func (c caused) Error() string { return "caused: " + c.err.Error() }
+func (c caused) Cause() error  { return c.err }
+
+func TestUnauthenticated(t *testing.T) {
+	unauth := status.Error(codes.Unauthenticated, "bad token")
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("plain"), false},
+		{status.Error(codes.PermissionDenied, "no"), false},
+		{unauth, true},
+		{wrapped{unauth}, true},
+		{caused{wrapped{unauth}}, true},
+		{wrapped{status.Error(codes.Unavailable, "down")}, false},
+	}
+	for _, tt := range tests {
+		if got := grpcdexy.Unauthenticated(tt.err); got != tt.want {
+			t.Errorf("Unauthenticated(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// authServer rejects calls without the "new" token.
+func authServer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md["authorization"]; len(auth) != 1 || auth[0] != "Bearer new" {
+		return nil, status.Error(codes.Unauthenticated, fmt.Sprintf("bad token %q", auth))
+	}
+	return handler(ctx, req)
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	l := bufconn.Listen(1 << 16)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(authServer))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	src := &fakeSource{}
+	// The credentials need transport security unless they allow otherwise.
+	opts := append(grpcdexy.DialOptions(src)[1:],
+		grpc.WithPerRPCCredentials(&dexy.RPCCredentials{Source: src, AllowInsecure: true}),
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) { return l.Dial() }))
+	conn, err := grpc.Dial("bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("call failed after the retry: %v", err)
+	}
+	if src.refreshes != 1 {
+		t.Errorf("%d refreshes, want 1", src.refreshes)
+	}
+}
+
+// fakeStream fails every RecvMsg with err.
+type fakeStream struct {
+	grpc.ClientStream
+	err error
+}
+
+func (s *fakeStream) RecvMsg(m interface{}) error { return s.err }
+
+func TestStreamClientInterceptor(t *testing.T) {
+	unauth := status.Error(codes.Unauthenticated, "bad token")
+	tests := []struct {
+		name          string
+		openErrs      []error
+		recvErr       error
+		wantOpens     int
+		wantRefreshes int
+		wantErr       bool
+	}{
+		{"accepted", []error{nil}, nil, 1, 0, false},
+		{"rejected on open", []error{unauth, nil}, nil, 2, 1, false},
+		{"rejected twice on open", []error{unauth, unauth}, nil, 2, 1, true},
+		{"rejected on receive", []error{nil}, unauth, 1, 1, false},
+		{"other error", []error{status.Error(codes.Unavailable, "down")}, nil, 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeSource{}
+			opens := 0
+			streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				err := tt.openErrs[opens]
+				opens++
+				if err != nil {
+					return nil, err
+				}
+				return &fakeStream{err: tt.recvErr}, nil
+			}
+			s, err := grpcdexy.StreamClientInterceptor(src)(context.Background(), &grpc.StreamDesc{}, nil, "/test", streamer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				// Only the first rejection refreshes the token.
+				s.RecvMsg(nil)
+				s.RecvMsg(nil)
+			}
+			if opens != tt.wantOpens {
+				t.Errorf("stream opened %d times, want %d", opens, tt.wantOpens)
+			}
+			if src.refreshes != tt.wantRefreshes {
+				t.Errorf("%d refreshes, want %d", src.refreshes, tt.wantRefreshes)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package dexy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/browser"
+	"github.com/pressly/chi"
+	"golang.org/x/oauth2"
+)
+
+// Login logs the user in and returns the provider's token response. The
+// Client verifies and caches what it returns.
+type Login interface {
+	Login(ctx context.Context, c *Client) (*oauth2.Token, error)
+}
+
+// AuthCodeURL returns the URL of the provider's login page, which sends the
+// user back to redirectURL with an authorization code. verifier is the PKCE
+// code verifier from CodeVerifier, or empty without PKCE.
+func (c *Client) AuthCodeURL(redirectURL, state, verifier string) (string, error) {
+	endpoint, err := c.Endpoint()
+	if err != nil {
+		return "", err
+	}
+	cfg := oauth2.Config{
+		ClientID:    c.cfg.ClientID,
+		RedirectURL: redirectURL,
+		Endpoint:    endpoint,
+		Scopes:      c.Scopes(),
+	}
+	opts := c.AuthCodeOptions()
+	if verifier != "" {
+		sum := sha256.Sum256([]byte(verifier))
+		opts = append(opts,
+			oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:])),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	}
+	return cfg.AuthCodeURL(state, opts...), nil
+}
+
+// ExchangeCode swaps an authorization code for a token, proving with
+// verifier that this is who asked for it when PKCE is used.
+func (c *Client) ExchangeCode(ctx context.Context, code, redirectURL, verifier string) (*oauth2.Token, error) {
+	v := url.Values{
+		"grant_type":   {GrantAuthCode},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	}
+	if verifier != "" {
+		v.Set("code_verifier", verifier)
+	}
+	return c.RequestToken(ctx, v)
+}
+
+// CodeVerifier returns a new PKCE code verifier (RFC 7636) for a login, or
+// "" if the config doesn't use PKCE.
+func (c *Client) CodeVerifier() (string, error) {
+	if !c.cfg.PKCE {
+		return "", nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// BrowserLogin opens the provider's login page in the user's browser, and
+// catches the redirect back with a local web server.
+type BrowserLogin struct {
+	// Host and Port make the redirect URI, http://Host:Port/oauth2/callback,
+	// which must be registered with the provider, and are where the callback
+	// is listened for. They default to localhost and 10111.
+	Host string
+	Port int
+
+	// OpenURL opens the login page, by default in the user's browser.
+	OpenURL func(url string) error
+}
+
+// Login implements Login.
+func (b BrowserLogin) Login(ctx context.Context, c *Client) (*oauth2.Token, error) {
+	host, port, open := b.Host, b.Port, b.OpenURL
+	if host == "" {
+		host = "localhost"
+	}
+	if port == 0 {
+		port = 10111
+	}
+	if open == nil {
+		open = browser.OpenURL
+	}
+	redirectURL := fmt.Sprintf("http://%s:%d/oauth2/callback", host, port)
+
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := c.CodeVerifier()
+	if err != nil {
+		return nil, err
+	}
+	authURL, err := c.AuthCodeURL(redirectURL, state, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := ListenCallback(host, port)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for the login callback %v", err)
+	}
+	type result struct {
+		tok *oauth2.Token
+		err error
+	}
+	results := make(chan result, 1)
+	r := chi.NewRouter()
+	r.Get("/oauth2/callback", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var res result
+		switch {
+		case q.Get("state") != state:
+			res.err = errors.New("login callback has the wrong state")
+		case q.Get("error") != "":
+			res.err = &RequestError{Code: q.Get("error"), Description: q.Get("error_description")}
+		default:
+			res.tok, res.err = c.ExchangeCode(r.Context(), q.Get("code"), redirectURL, verifier)
+		}
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintf(w, "Done, you can now close this window")
+		}
+		select {
+		case results <- res:
+		default:
+		}
+	})
+	srv := &http.Server{Handler: r}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	if err := open(authURL); err != nil {
+		return nil, fmt.Errorf("error while opening new web browser %v", err)
+	}
+	select {
+	case res := <-results:
+		return res.tok, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ListenCallback listens for a browser login's callback on host and port.
+// localhost, or no host, means the IPv4 loopback address, so nothing but
+// this machine can reach the listener.
+func ListenCallback(host string, port int) (net.Listener, error) {
+	if host == "" || host == "localhost" {
+		host = "127.0.0.1"
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// OOBRedirectURL asks the provider to show the authorization code to the
+// user instead of redirecting anywhere. Dex supports it.
+const OOBRedirectURL = "urn:ietf:wg:oauth:2.0:oob"
+
+// PasteLogin shows the user the provider's login page URL and has them
+// paste back the code the provider shows after they log in. It works over
+// SSH, where no browser can reach a local server.
+type PasteLogin struct {
+	// RedirectURL defaults to urn:ietf:wg:oauth:2.0:oob.
+	RedirectURL string
+
+	// Prompt shows the user authURL and returns the code they paste. By
+	// default it uses stderr and stdin.
+	Prompt func(authURL string) (code string, err error)
+}
+
+// Login implements Login.
+func (p PasteLogin) Login(ctx context.Context, c *Client) (*oauth2.Token, error) {
+	redirectURL, prompt := p.RedirectURL, p.Prompt
+	if redirectURL == "" {
+		redirectURL = OOBRedirectURL
+	}
+	if prompt == nil {
+		prompt = promptForCode
+	}
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := c.CodeVerifier()
+	if err != nil {
+		return nil, err
+	}
+	authURL, err := c.AuthCodeURL(redirectURL, state, verifier)
+	if err != nil {
+		return nil, err
+	}
+	code, err := prompt(authURL)
+	if err != nil {
+		return nil, err
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return nil, errors.New("no code given")
+	}
+	return c.ExchangeCode(ctx, code, redirectURL, verifier)
+}
+
+func promptForCode(authURL string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Open this URL in a browser and log in:\n\n  %s\n\nThen paste the code here: ", authURL)
+	code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(err == io.EOF && code != "") {
+		return "", fmt.Errorf("error while reading code %v", err)
+	}
+	return code, nil
+}
+
+// GrantDeviceCode is the device authorization grant, used by DeviceLogin.
+const GrantDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceLogin uses the device authorization grant (RFC 8628). The user is
+// given a code to enter on the provider's site from any device, while dexy
+// waits for them to finish.
+type DeviceLogin struct {
+	// Prompt tells the user where to log in and with what code. By default
+	// it writes to stderr.
+	Prompt func(verificationURI, userCode, verificationURIComplete string)
+}
+
+type deviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// Login implements Login.
+func (d DeviceLogin) Login(ctx context.Context, c *Client) (*oauth2.Token, error) {
+	prompt := d.Prompt
+	if prompt == nil {
+		prompt = promptForDevice
+	}
+	endpoint, err := c.deviceEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{
+		"client_id": {c.cfg.ClientID},
+		"scope":     {strings.Join(c.Scopes(), " ")},
+	}
+	body, err := c.post(ctx, endpoint, v)
+	if err != nil {
+		return nil, err
+	}
+	var auth deviceAuthorization
+	if err := json.Unmarshal(body, &auth); err != nil {
+		return nil, fmt.Errorf("cannot decode device authorization response %v", err)
+	}
+	if auth.DeviceCode == "" {
+		return nil, errors.New("device authorization response has no device_code")
+	}
+	prompt(auth.VerificationURI, auth.UserCode, auth.VerificationURIComplete)
+
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	for auth.ExpiresIn == 0 || time.Now().Before(deadline) {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		tok, err := c.RequestToken(ctx, url.Values{
+			"grant_type":  {GrantDeviceCode},
+			"device_code": {auth.DeviceCode},
+			"client_id":   {c.cfg.ClientID},
+		})
+		if re, ok := err.(*RequestError); ok {
+			switch re.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += 5 * time.Second
+				continue
+			}
+		}
+		return tok, err
+	}
+	return nil, errors.New("device code expired before the login was finished")
+}
+
+// deviceEndpoint returns the provider's device authorization endpoint,
+// falling back to where dex serves it for providers that don't advertise it.
+func (c *Client) deviceEndpoint() (string, error) {
+	m, err := Discover(c.cfg.Issuer)
+	if err != nil {
+		return "", err
+	}
+	if m.DeviceAuthorizationEndpoint != "" {
+		return m.DeviceAuthorizationEndpoint, nil
+	}
+	return strings.TrimSuffix(c.cfg.Issuer, "/") + "/device/code", nil
+}
+
+func promptForDevice(verificationURI, userCode, verificationURIComplete string) {
+	if verificationURIComplete != "" {
+		fmt.Fprintf(os.Stderr, "To log in, open %s\nor go to %s and enter the code %s\n", verificationURIComplete, verificationURI, userCode)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "To log in, go to %s and enter the code %s\n", verificationURI, userCode)
+}
+
+// PasswordLogin uses the resource owner password grant, which dex supports
+// for connectors like LDAP and local passwords.
+type PasswordLogin struct {
+	// Credentials returns the username and password to log in with.
+	Credentials func() (username, password string, err error)
+}
+
+// Login implements Login.
+func (p PasswordLogin) Login(ctx context.Context, c *Client) (*oauth2.Token, error) {
+	if p.Credentials == nil {
+		return nil, errors.New("password login has no way to get credentials")
+	}
+	username, password, err := p.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	tok, err := c.RequestToken(ctx, url.Values{
+		"grant_type": {"password"},
+		"username":   {username},
+		"password":   {password},
+		"scope":      {strings.Join(c.Scopes(), " ")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tok.Extra("id_token").(string); !ok {
+		return nil, errors.New("missing id_token")
+	}
+	return tok, nil
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,65 @@
+package dexy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/go-oidc"
+)
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]*oidc.Provider{}
+)
+
+// providerFor returns the provider for issuer, doing discovery only the
+// first time it is asked for. This matters for long running programs like
+// the agent, which would otherwise fetch discovery on every refresh.
+func providerFor(issuer string) (*oidc.Provider, error) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if provider, ok := providers[issuer]; ok {
+		return provider, nil
+	}
+	// The provider's key set keeps using the context it was created with,
+	// so it mustn't be tied to the context of a single request.
+	provider, err := oidc.NewProvider(context.Background(), issuer)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating new oidc provider %v", err)
+	}
+	providers[issuer] = provider
+	return provider, nil
+}
+
+// Metadata is what a provider says about itself in its discovery document.
+type Metadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	RegistrationEndpoint              string   `json:"registration_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// Discover fetches the discovery document of issuer, checking that it
+// really is for issuer.
+func Discover(issuer string) (*Metadata, error) {
+	provider, err := providerFor(issuer)
+	if err != nil {
+		return nil, err
+	}
+	var m Metadata
+	if err := provider.Claims(&m); err != nil {
+		return nil, fmt.Errorf("cannot decode discovery document %v", err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,152 @@
+package dexy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// ClientMetadata describes a client to register with the provider, as in
+// RFC 7591 section 2.
+type ClientMetadata struct {
+	ClientName              string   `json:"client_name,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ApplicationType         string   `json:"application_type,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+// Registration is a registered client. RegistrationAccessToken and
+// RegistrationClientURI, when the provider returns them, are what reading,
+// updating and deleting the registration later needs (RFC 7592).
+type Registration struct {
+	ClientMetadata
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
+}
+
+// RegistrationEndpoint returns the issuer's dynamic client registration
+// endpoint, if it advertises one.
+func RegistrationEndpoint(issuer string) (string, error) {
+	m, err := Discover(issuer)
+	if err != nil {
+		return "", err
+	}
+	if m.RegistrationEndpoint == "" {
+		return "", fmt.Errorf("%s does not support dynamic client registration", issuer)
+	}
+	return m.RegistrationEndpoint, nil
+}
+
+// Register registers a new client with the issuer. initialAccessToken is
+// only needed by providers that restrict who may register clients.
+func Register(ctx context.Context, issuer, initialAccessToken string, m ClientMetadata) (*Registration, error) {
+	endpoint, err := RegistrationEndpoint(issuer)
+	if err != nil {
+		return nil, err
+	}
+	return registrationRequest(ctx, "POST", endpoint, initialAccessToken, m)
+}
+
+// ReadRegistration fetches the provider's current view of a registration.
+func ReadRegistration(ctx context.Context, r *Registration) (*Registration, error) {
+	if err := r.manageable(); err != nil {
+		return nil, err
+	}
+	return registrationRequest(ctx, "GET", r.RegistrationClientURI, r.RegistrationAccessToken, nil)
+}
+
+// UpdateRegistration replaces the metadata of a registration with m.
+func UpdateRegistration(ctx context.Context, r *Registration, m ClientMetadata) (*Registration, error) {
+	if err := r.manageable(); err != nil {
+		return nil, err
+	}
+	// The update must repeat the client's ID, and its secret if it has one.
+	body := struct {
+		ClientMetadata
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret,omitempty"`
+	}{m, r.ClientID, r.ClientSecret}
+	return registrationRequest(ctx, "PUT", r.RegistrationClientURI, r.RegistrationAccessToken, body)
+}
+
+// DeleteRegistration deletes a registration, after which its client can't
+// be used any more.
+func DeleteRegistration(ctx context.Context, r *Registration) error {
+	if err := r.manageable(); err != nil {
+		return err
+	}
+	_, err := registrationRequest(ctx, "DELETE", r.RegistrationClientURI, r.RegistrationAccessToken, nil)
+	return err
+}
+
+func (r *Registration) manageable() error {
+	if r.RegistrationClientURI == "" || r.RegistrationAccessToken == "" {
+		return errors.New("no registration access token and client URI for the client")
+	}
+	return nil
+}
+
+// registrationRequest sends body as JSON to a registration endpoint and
+// decodes the registration it returns. DELETE returns none.
+func registrationRequest(ctx context.Context, method, endpoint, token string, body interface{}) (*Registration, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, endpoint, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read registration response %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var re RequestError
+		if json.Unmarshal(respBody, &re) == nil && re.Code != "" {
+			return nil, fmt.Errorf("registration failed: %s: %s", re.Code, re.Description)
+		}
+		return nil, fmt.Errorf("registration failed: %s: %s", resp.Status, respBody)
+	}
+	if method == "DELETE" {
+		return nil, nil
+	}
+
+	var r Registration
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return nil, fmt.Errorf("cannot decode registration response %v", err)
+	}
+	if r.ClientID == "" {
+		return nil, errors.New("registration response has no client_id")
+	}
+	return &r, nil
+}
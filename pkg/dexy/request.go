@@ -0,0 +1,190 @@
+package dexy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const jwtBearerAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// RequestError is an error response from the provider, as defined in RFC
+// 6749 section 5.2.
+type RequestError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *RequestError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("token request failed: %s: %s", e.Code, e.Description)
+	}
+	return fmt.Sprintf("token request failed: %s", e.Code)
+}
+
+type tokenJSON struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// RequestToken posts v to the provider's token endpoint, authenticating as
+// the client. The oauth2 package only knows a handful of grants and
+// client_secret_basic, so grants that need more than that go through here.
+func (c *Client) RequestToken(ctx context.Context, v url.Values) (*oauth2.Token, error) {
+	provider, err := providerFor(c.cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.post(ctx, provider.Endpoint().TokenURL, v)
+	if err != nil {
+		return nil, err
+	}
+
+	var tj tokenJSON
+	if err := json.Unmarshal(body, &tj); err != nil {
+		return nil, fmt.Errorf("cannot decode token response %v", err)
+	}
+	raw := map[string]interface{}{}
+	json.Unmarshal(body, &raw)
+
+	tok := &oauth2.Token{
+		AccessToken:  tj.AccessToken,
+		TokenType:    tj.TokenType,
+		RefreshToken: tj.RefreshToken,
+	}
+	if tj.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(tj.ExpiresIn) * time.Second)
+	}
+	return tok.WithExtra(raw), nil
+}
+
+// post sends a form authenticated as the client to one of the provider's
+// endpoints and returns the response body, turning error responses into
+// RequestErrors.
+func (c *Client) post(ctx context.Context, endpoint string, v url.Values) ([]byte, error) {
+	basicAuth := true
+	if c.cfg.AssertionKeyFile != "" {
+		assertion, err := c.clientAssertion(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		v.Set("client_id", c.cfg.ClientID)
+		v.Set("client_assertion_type", jwtBearerAssertionType)
+		v.Set("client_assertion", assertion)
+		basicAuth = false
+	}
+
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basicAuth {
+		req.SetBasicAuth(c.cfg.ClientID, c.cfg.ClientSecret)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read token response %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var re RequestError
+		if json.Unmarshal(body, &re) == nil && re.Code != "" {
+			return nil, &re
+		}
+		return nil, fmt.Errorf("token request failed: %s: %s", resp.Status, body)
+	}
+	return body, nil
+}
+
+// clientAssertion builds a private_key_jwt client assertion (RFC 7523) for
+// the given endpoint, signed with the client's assertion key.
+func (c *Client) clientAssertion(endpoint string) (string, error) {
+	b, err := ioutil.ReadFile(c.cfg.AssertionKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read client assertion key %v", err)
+	}
+	key, err := parsePrivateKey(b)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse client assertion key %v", err)
+	}
+
+	alg := jose.SignatureAlgorithm(c.cfg.AssertionAlg)
+	if alg == "" {
+		switch key.(type) {
+		case *ecdsa.PrivateKey:
+			alg = jose.ES256
+		default:
+			alg = jose.RS256
+		}
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: key, KeyID: c.cfg.AssertionKeyID},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:   c.cfg.ClientID,
+		Subject:  c.cfg.ClientID,
+		Audience: jwt.Audience{endpoint},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		ID:       hex.EncodeToString(jti),
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// parsePrivateKey reads an RSA or EC private key from PEM.
+func parsePrivateKey(b []byte) (interface{}, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		switch key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format")
+}
@@ -0,0 +1,99 @@
+package dexy
+
+import (
+	"context"
+	"reflect"
+)
+
+// unauthenticated is the gRPC Unauthenticated status code.
+const unauthenticated = 16
+
+// RPCCredentials adds the current token to gRPC calls. It implements
+// google.golang.org/grpc/credentials.PerRPCCredentials, without this
+// package having to depend on gRPC. Package grpcdexy sets it up along with
+// interceptors that retry calls the server rejects:
+//
+//	conn, err := grpc.Dial(addr, append(grpcdexy.DialOptions(c),
+//		grpc.WithTransportCredentials(credentials.NewTLS(nil)))...)
+type RPCCredentials struct {
+	Source Source
+	// AllowInsecure lets the token be sent over connections without
+	// transport security, for talking to local servers.
+	AllowInsecure bool
+}
+
+// GetRequestMetadata implements PerRPCCredentials.
+func (c *RPCCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	tok, err := c.Source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + tok.AccessToken}, nil
+}
+
+// RequireTransportSecurity implements PerRPCCredentials.
+func (c *RPCCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
+
+// Retry runs call, and if it fails with Unauthenticated refreshes the token
+// and runs it once more. Use it from a client interceptor.
+func (c *RPCCredentials) Retry(ctx context.Context, call func(ctx context.Context) error) error {
+	tok, err := c.Source.Token(ctx)
+	if err != nil {
+		return err
+	}
+	err = call(ctx)
+	if !isUnauthenticated(err) {
+		return err
+	}
+	if _, refreshErr := c.Source.Refresh(ctx, tok); refreshErr != nil {
+		return err
+	}
+	return call(ctx)
+}
+
+// isUnauthenticated reports whether err, or an error it wraps, is a gRPC
+// status error with the Unauthenticated code.
+func isUnauthenticated(err error) bool {
+	for err != nil {
+		if code, ok := statusCode(err); ok {
+			return code == unauthenticated
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// statusCode returns the code of a gRPC status error. Status errors have a
+// GRPCStatus method returning a status with a Code method; they are found by
+// name to avoid importing gRPC.
+func statusCode(err error) (uint64, bool) {
+	m := reflect.ValueOf(err).MethodByName("GRPCStatus")
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return 0, false
+	}
+	status := m.Call(nil)[0]
+	if status.Kind() == reflect.Ptr && status.IsNil() {
+		return 0, false
+	}
+	code := status.MethodByName("Code")
+	if !code.IsValid() || code.Type().NumIn() != 0 || code.Type().NumOut() != 1 {
+		return 0, false
+	}
+	v := code.Call(nil)[0]
+	switch v.Kind() {
+	case reflect.Uint32, reflect.Uint, reflect.Uint64:
+		return v.Uint(), true
+	case reflect.Int32, reflect.Int, reflect.Int64:
+		return uint64(v.Int()), true
+	}
+	return 0, false
+}
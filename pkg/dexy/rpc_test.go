@@ -0,0 +1,60 @@
+package dexy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+)
+
+// fakeStatus looks like a gRPC status to RPCCredentials.
+type fakeStatus struct{ code uint32 }
+
+func (s *fakeStatus) Code() uint32 { return s.code }
+
+type statusError struct{ code uint32 }
+
+func (e statusError) Error() string           { return fmt.Sprintf("rpc error: code = %d", e.code) }
+func (e statusError) GRPCStatus() *fakeStatus { return &fakeStatus{e.code} }
+
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e wrappedError) Error() string { return e.msg + ": " + e.err.Error() }
+func (e wrappedError) Unwrap() error { return e.err }
+
+func TestRPCCredentialsRetry(t *testing.T) {
+	const unauthenticated, unavailable = 16, 14
+	tests := []struct {
+		name          string
+		err           error
+		wantRefreshes int
+	}{
+		{"ok", nil, 0},
+		{"other error", errors.New("boom"), 0},
+		{"unavailable", statusError{unavailable}, 0},
+		{"unauthenticated", statusError{unauthenticated}, 1},
+		{"wrapped unauthenticated", wrappedError{"calling", statusError{unauthenticated}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeSource{}
+			creds := &dexy.RPCCredentials{Source: src}
+			calls := 0
+			creds.Retry(context.Background(), func(ctx context.Context) error {
+				calls++
+				if calls > 1 {
+					return nil
+				}
+				return tt.err
+			})
+			if src.refreshes != tt.wantRefreshes || calls != 1+tt.wantRefreshes {
+				t.Errorf("%d refreshes and %d calls, want %d and %d", src.refreshes, calls, tt.wantRefreshes, 1+tt.wantRefreshes)
+			}
+		})
+	}
+}
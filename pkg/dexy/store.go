@@ -0,0 +1,147 @@
+package dexy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// Store is the on-disk token cache shared by everything using dexy. It holds
+// one token per key (usually the profile name) in a single JSON file.
+type Store struct {
+	path string
+
+	// MaxAge, if set, is how long after a login its tokens can be used,
+	// refresh tokens included. Older tokens are treated as missing, so the
+	// user has to log in again.
+	MaxAge time.Duration
+}
+
+// NewStore returns the cache kept in the file at path.
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// DefaultStorePath is where the dexy command keeps its cache.
+func DefaultStorePath() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".dexy-token.yaml"), nil
+}
+
+// read returns everything in the cache. A missing or unreadable cache (for
+// example one written by an older dexy) is treated as empty.
+func (s *Store) read() map[string]*Token {
+	toks := map[string]*Token{}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return toks
+	}
+	if err := json.Unmarshal(b, &toks); err != nil {
+		return map[string]*Token{}
+	}
+	return toks
+}
+
+// Get returns the cached token for key, or nil if there isn't one.
+func (s *Store) Get(key string) *Token {
+	tok := s.read()[key]
+	if tok != nil && s.MaxAge > 0 && (tok.LoginTime == nil || time.Since(*tok.LoginTime) > s.MaxAge) {
+		return nil
+	}
+	return tok
+}
+
+// Put caches tok under key. Tokens without a LoginTime are taken to come
+// from a login that just happened.
+func (s *Store) Put(key string, tok *Token) error {
+	if tok.LoginTime == nil {
+		now := time.Now()
+		tok.LoginTime = &now
+	}
+	return s.update(func(toks map[string]*Token) bool {
+		toks[key] = tok
+		return true
+	})
+}
+
+// Invalidate drops the access token for key so the next request gets a new
+// one, but keeps the refresh token so that doesn't need a new login.
+func (s *Store) Invalidate(key string) error {
+	return s.update(func(toks map[string]*Token) bool {
+		tok, ok := toks[key]
+		if !ok {
+			return false
+		}
+		if tok.RefreshToken == "" {
+			delete(toks, key)
+		} else {
+			toks[key] = &Token{RefreshToken: tok.RefreshToken, LoginTime: tok.LoginTime}
+		}
+		return true
+	})
+}
+
+// Forget removes the token for key along with every token derived from it,
+// such as tokens for other audiences.
+func (s *Store) Forget(key string) error {
+	return s.update(func(toks map[string]*Token) bool {
+		found := false
+		for k := range toks {
+			if k == key || strings.HasPrefix(k, key+"@") || strings.HasPrefix(k, key+"#") {
+				delete(toks, k)
+				found = true
+			}
+		}
+		return found
+	})
+}
+
+// update reads the cache, lets change modify it and writes it back if change
+// returns true. Other processes updating the cache at the same time wait on a
+// lock file next to it, so no one's change is lost.
+func (s *Store) update(change func(toks map[string]*Token) bool) error {
+	lock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	toks := s.read()
+	if !change(toks) {
+		return nil
+	}
+	return s.write(toks)
+}
+
+func (s *Store) write(toks map[string]*Token) error {
+	b, err := json.MarshalIndent(toks, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it over the cache, so a reader
+	// never sees a half written file.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
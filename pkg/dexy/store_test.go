@@ -0,0 +1,114 @@
+package dexy_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+)
+
+func TestStorePutGet(t *testing.T) {
+	s := dexy.NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if tok := s.Get("dev"); tok != nil {
+		t.Fatalf("empty store has %+v", tok)
+	}
+	tok := &dexy.Token{AccessToken: "a", ExpiryTime: time.Now().Add(time.Hour)}
+	if err := s.Put("dev", tok); err != nil {
+		t.Fatal(err)
+	}
+	if tok.LoginTime == nil {
+		t.Error("Put didn't set the login time")
+	}
+	got := s.Get("dev")
+	if got == nil || got.AccessToken != "a" {
+		t.Fatalf("Get = %+v, want the token put", got)
+	}
+}
+
+func TestStoreMaxAge(t *testing.T) {
+	s := dexy.NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	old := time.Now().Add(-2 * time.Hour)
+	if err := s.Put("old", &dexy.Token{AccessToken: "a", LoginTime: &old}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("new", &dexy.Token{AccessToken: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	s.MaxAge = time.Hour
+	if tok := s.Get("old"); tok != nil {
+		t.Error("got a token older than MaxAge")
+	}
+	if tok := s.Get("new"); tok == nil {
+		t.Error("didn't get a token newer than MaxAge")
+	}
+}
+
+func TestStoreInvalidate(t *testing.T) {
+	s := dexy.NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	s.Put("refreshable", &dexy.Token{AccessToken: "a", RefreshToken: "r"})
+	s.Put("plain", &dexy.Token{AccessToken: "b"})
+
+	for _, key := range []string{"refreshable", "plain", "missing"} {
+		if err := s.Invalidate(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tok := s.Get("refreshable")
+	if tok == nil || tok.AccessToken != "" || tok.RefreshToken != "r" || tok.LoginTime == nil {
+		t.Errorf("invalidated token is %+v, want only its refresh token and login time", tok)
+	}
+	if tok := s.Get("plain"); tok != nil {
+		t.Errorf("invalidated token without a refresh token is %+v, want it gone", tok)
+	}
+}
+
+func TestStoreForget(t *testing.T) {
+	s := dexy.NewStore(filepath.Join(t.TempDir(), "tokens.json"))
+	for _, key := range []string{"dev", "dev@other", "dev#vault:x", "devel"} {
+		if err := s.Put(key, &dexy.Token{AccessToken: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Forget("dev"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"dev", "dev@other", "dev#vault:x"} {
+		if s.Get(key) != nil {
+			t.Errorf("%s wasn't forgotten", key)
+		}
+	}
+	if s.Get("devel") == nil {
+		t.Error("devel was forgotten along with dev")
+	}
+}
+
+func TestStoreConcurrentPut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Separate stores, like separate dexy processes.
+			s := dexy.NewStore(path)
+			for j := 0; j < 10; j++ {
+				if err := s.Put(fmt.Sprintf("%d-%d", i, j), &dexy.Token{AccessToken: "a"}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s := dexy.NewStore(path)
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			if s.Get(fmt.Sprintf("%d-%d", i, j)) == nil {
+				t.Errorf("token %d-%d was lost", i, j)
+			}
+		}
+	}
+}
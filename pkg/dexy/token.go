@@ -0,0 +1,51 @@
+package dexy
+
+import "time"
+
+// Token is what dexy caches and hands back to callers. AccessToken is the ID
+// token when the provider issued one, in which case the OAuth2 access token
+// is kept in OAuth2AccessToken for the few callers that want it. The refresh
+// token is only ever written to the cache, never handed out.
+//
+// Credentials dexy gets in exchange for a token, like AWS keys, are cached
+// as Tokens too, with anything beyond the token itself in Data.
+type Token struct {
+	AccessToken       string            `json:"access_token"`
+	ExpiryTime        time.Time         `json:"expiry_time"`
+	OAuth2AccessToken string            `json:"oauth2_access_token,omitempty"`
+	RefreshToken      string            `json:"refresh_token,omitempty"`
+	Data              map[string]string `json:"data,omitempty"`
+
+	// LoginTime is when the login the token came from happened. Refreshed
+	// tokens keep the time of the original login.
+	LoginTime *time.Time `json:"login_time,omitempty"`
+}
+
+// Valid reports whether t is a token that hasn't expired yet.
+func (t *Token) Valid() bool {
+	return t.ValidFor(0)
+}
+
+// ValidFor reports whether t will still be valid in d.
+func (t *Token) ValidFor(d time.Duration) bool {
+	return t != nil && t.AccessToken != "" && t.ExpiryTime.After(time.Now().Add(d))
+}
+
+// Public returns a copy of t without the refresh token, for handing out.
+func (t *Token) Public() *Token {
+	return &Token{
+		AccessToken:       t.AccessToken,
+		ExpiryTime:        t.ExpiryTime,
+		OAuth2AccessToken: t.OAuth2AccessToken,
+		LoginTime:         t.LoginTime,
+	}
+}
+
+// RawAccessToken returns the OAuth2 access token, which is AccessToken itself
+// when the provider didn't issue an ID token.
+func (t *Token) RawAccessToken() string {
+	if t.OAuth2AccessToken != "" {
+		return t.OAuth2AccessToken
+	}
+	return t.AccessToken
+}
@@ -0,0 +1,41 @@
+package dexy
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenSource returns an oauth2.TokenSource backed by the client, so any
+// library taking one can use dexy's tokens. Tokens come from and go to the
+// client's cache, and are refreshed as they expire. The access token it
+// returns is the ID token when the provider issued one, as with the dexy
+// command; the OAuth2 access token is in the "access_token" extra.
+func (c *Client) TokenSource(ctx context.Context) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, &tokenSource{ctx: ctx, c: c})
+}
+
+type tokenSource struct {
+	ctx context.Context
+	c   *Client
+}
+
+func (s *tokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.c.Token(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return OAuth2Token(tok), nil
+}
+
+// OAuth2Token converts tok to an oauth2.Token, without its refresh token.
+func OAuth2Token(tok *Token) *oauth2.Token {
+	o := &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      tok.ExpiryTime,
+	}
+	return o.WithExtra(map[string]interface{}{
+		"access_token": tok.RawAccessToken(),
+	})
+}
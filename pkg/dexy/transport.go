@@ -0,0 +1,107 @@
+package dexy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Source is where the adapters get tokens from. *Client is a Source.
+type Source interface {
+	Token(ctx context.Context) (*Token, error)
+	// Refresh replaces a token a server rejected.
+	Refresh(ctx context.Context, rejected *Token) (*Token, error)
+}
+
+// maxReplayBody is the largest request body buffered so the request can be
+// retried after a 401. Requests with larger bodies, or bodies of unknown
+// length, are only retried if they have a GetBody.
+const maxReplayBody = 1 << 20
+
+// Transport is an http.RoundTripper that adds the current token to every
+// request as an Authorization: Bearer header. A request rejected with 401 is
+// retried once with a refreshed token, as long as its body can be sent
+// again.
+//
+//	httpClient := &http.Client{Transport: &dexy.Transport{Source: c}}
+type Transport struct {
+	Source Source
+	// Base sends the requests, http.DefaultTransport if nil.
+	Base http.RoundTripper
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	tok, err := t.Source.Token(r.Context())
+	if err != nil {
+		// A RoundTripper always closes the body, even on errors.
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+
+	// The request can only be sent again if its body can be: there is
+	// none, GetBody makes a new copy, or it is small, of known length and
+	// buffered here. Anything else is sent untouched and not retried.
+	var (
+		first   io.ReadCloser
+		getBody func() (io.ReadCloser, error)
+	)
+	switch {
+	case r.Body == nil || r.Body == http.NoBody:
+		getBody = func() (io.ReadCloser, error) { return r.Body, nil }
+	case r.GetBody != nil:
+		getBody = r.GetBody
+	case r.ContentLength > 0 && r.ContentLength <= maxReplayBody:
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		getBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil }
+		first, _ = getBody()
+	}
+
+	resp, err := t.base().RoundTrip(withToken(r, tok, first))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || getBody == nil {
+		return resp, err
+	}
+
+	tok, err = t.Source.Refresh(r.Context(), tok)
+	if err != nil {
+		// The 401 says more about what went wrong than the failed refresh.
+		return resp, nil
+	}
+	body, err := getBody()
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.base().RoundTrip(withToken(r, tok, body))
+}
+
+// withToken returns a copy of r carrying tok. If body isn't nil it replaces
+// r's body, so the request can be sent more than once.
+func withToken(r *http.Request, tok *Token, body io.ReadCloser) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		r2.Header[k] = append([]string(nil), v...)
+	}
+	r2.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	if body != nil {
+		r2.Body = body
+	}
+	return r2
+}
@@ -0,0 +1,238 @@
+package dexy_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/chronojam/dexy/pkg/dexy/dexytest"
+)
+
+// fakeSource hands out "old" until it is refreshed, then "new".
+type fakeSource struct {
+	mu        sync.Mutex
+	current   string
+	refreshes int
+}
+
+func (s *fakeSource) Token(ctx context.Context) (*dexy.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == "" {
+		s.current = "old"
+	}
+	return &dexy.Token{AccessToken: s.current, ExpiryTime: time.Now().Add(time.Hour)}, nil
+}
+
+func (s *fakeSource) Refresh(ctx context.Context, rejected *dexy.Token) (*dexy.Token, error) {
+	s.mu.Lock()
+	s.refreshes++
+	s.current = "new"
+	s.mu.Unlock()
+	return s.Token(ctx)
+}
+
+// bodyServer accepts only the "new" token, and records the bodies it was
+// sent.
+type bodyServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newBodyServer() *bodyServer {
+	s := &bodyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, string(b))
+		s.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer new" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	return s
+}
+
+func TestTransportRetries(t *testing.T) {
+	srv := newBodyServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		req  func() *http.Request
+	}{
+		{"no body", func() *http.Request {
+			r, _ := http.NewRequest("GET", srv.URL, nil)
+			return r
+		}},
+		{"with GetBody", func() *http.Request {
+			r, _ := http.NewRequest("POST", srv.URL, strings.NewReader("hello"))
+			return r
+		}},
+		{"known length", func() *http.Request {
+			r, _ := http.NewRequest("POST", srv.URL, ioutil.NopCloser(strings.NewReader("hello")))
+			r.ContentLength = 5
+			return r
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeSource{}
+			srv.bodies = nil
+			c := &http.Client{Transport: &dexy.Transport{Source: src}}
+			resp, err := c.Do(tt.req())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d, want 200 after the retry", resp.StatusCode)
+			}
+			if src.refreshes != 1 {
+				t.Errorf("%d refreshes, want 1", src.refreshes)
+			}
+			if len(srv.bodies) != 2 || srv.bodies[0] != srv.bodies[1] {
+				t.Errorf("server got bodies %q, want the same one twice", srv.bodies)
+			}
+		})
+	}
+}
+
+func TestTransportDoesNotRetryUnreplayableBodies(t *testing.T) {
+	srv := newBodyServer()
+	defer srv.Close()
+	large := strings.Repeat("x", 2<<20)
+
+	tests := []struct {
+		name string
+		req  func() *http.Request
+		want string
+	}{
+		{"unknown length", func() *http.Request {
+			r, _ := http.NewRequest("POST", srv.URL, ioutil.NopCloser(strings.NewReader("hello")))
+			return r
+		}, "hello"},
+		{"too large", func() *http.Request {
+			r, _ := http.NewRequest("POST", srv.URL, ioutil.NopCloser(bytes.NewReader([]byte(large))))
+			r.ContentLength = int64(len(large))
+			return r
+		}, large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeSource{}
+			srv.bodies = nil
+			c := &http.Client{Transport: &dexy.Transport{Source: src}}
+			resp, err := c.Do(tt.req())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("status %d, want the 401", resp.StatusCode)
+			}
+			if src.refreshes != 0 {
+				t.Errorf("%d refreshes, want none", src.refreshes)
+			}
+			if len(srv.bodies) != 1 || srv.bodies[0] != tt.want {
+				t.Errorf("server got %d bodies, want the whole body once", len(srv.bodies))
+			}
+		})
+	}
+}
+
+func TestTransportWithClient(t *testing.T) {
+	iss := dexytest.NewServer()
+	defer iss.Close()
+	iss.Clients = map[string]string{"ci": "s3cret"}
+	c := newClient(t, iss, dexy.Config{
+		Grant:        dexy.GrantClientCredentials,
+		ClientID:     "ci",
+		ClientSecret: "s3cret",
+	})
+
+	// The server rejects the first request, which is retried with a token
+	// from a new client credentials grant.
+	var mu sync.Mutex
+	var seen []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		if len(seen) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer api.Close()
+
+	src := &countingSource{Source: c}
+	hc := &http.Client{Transport: &dexy.Transport{Source: src}}
+	resp, err := hc.Get(api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want 200", resp.StatusCode)
+	}
+	if src.refreshes != 1 {
+		t.Errorf("%d refreshes, want 1", src.refreshes)
+	}
+	if len(seen) != 2 || !strings.HasPrefix(seen[1], "Bearer ey") {
+		t.Errorf("api got Authorization headers %q, want two bearer tokens", seen)
+	}
+}
+
+// countingSource counts the refreshes of a Source.
+type countingSource struct {
+	dexy.Source
+	refreshes int
+}
+
+func (s *countingSource) Refresh(ctx context.Context, rejected *dexy.Token) (*dexy.Token, error) {
+	s.refreshes++
+	return s.Source.Refresh(ctx, rejected)
+}
+
+// failingSource can't get a token.
+type failingSource struct{}
+
+func (failingSource) Token(ctx context.Context) (*dexy.Token, error) {
+	return nil, errors.New("no token")
+}
+
+func (failingSource) Refresh(ctx context.Context, rejected *dexy.Token) (*dexy.Token, error) {
+	return nil, errors.New("no token")
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTransportClosesBodyOnTokenError(t *testing.T) {
+	body := &closeRecorder{Reader: strings.NewReader("hello")}
+	r, _ := http.NewRequest("POST", "http://127.0.0.1:1", body)
+	if _, err := (&dexy.Transport{Source: failingSource{}}).RoundTrip(r); err == nil {
+		t.Fatal("RoundTrip succeeded without a token")
+	}
+	if !body.closed {
+		t.Error("RoundTrip didn't close the request body")
+	}
+}
@@ -0,0 +1,69 @@
+package dexy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// issuerRel is the WebFinger link relation of a user's OpenID Connect
+// issuer.
+const issuerRel = "http://openid.net/specs/connect/1.0/issuer"
+
+// DiscoverIssuer finds the issuer for an email address with OpenID Connect
+// WebFinger discovery, asking https://<domain of the address>. server, if
+// not empty, is asked instead, for domains that don't serve WebFinger
+// themselves.
+func DiscoverIssuer(ctx context.Context, email, server string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at < 1 || at == len(email)-1 {
+		return "", fmt.Errorf("%q is not an email address", email)
+	}
+	if server == "" {
+		server = "https://" + email[at+1:]
+	}
+	u := strings.TrimSuffix(server, "/") + "/.well-known/webfinger?" + url.Values{
+		"resource": {"acct:" + email},
+		"rel":      {issuerRel},
+	}.Encode()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/jrd+json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("webfinger: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("webfinger: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("webfinger: %s asking %s", resp.Status, server)
+	}
+
+	var jrd struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := json.Unmarshal(body, &jrd); err != nil {
+		return "", fmt.Errorf("webfinger: cannot decode response %v", err)
+	}
+	for _, l := range jrd.Links {
+		if l.Rel == issuerRel && l.Href != "" {
+			return l.Href, nil
+		}
+	}
+	return "", errors.New("webfinger: response has no issuer for " + email)
+}
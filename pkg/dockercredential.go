@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// dockerCredentialHelperName is the name docker looks for when
+// ~/.docker/config.json has "credHelpers": {"<registry>": "dexy"}.
+const dockerCredentialHelperName = "docker-credential-dexy"
+
+// errCredentialsNotFound is the message docker expects from a helper that
+// has nothing for a server.
+const errCredentialsNotFound = "credentials not found in native keychain"
+
+// dockerCredentialCmd implements docker's credential helper protocol. It is
+// also what runs when dexy is invoked as docker-credential-dexy.
+var dockerCredentialCmd = &cobra.Command{
+	Use:   "docker-credential get|store|erase|list",
+	Short: "Docker credential helper that uses dexy tokens as registry secrets",
+	Long: `Docker credential helper that uses dexy tokens as registry secrets.
+
+Symlink dexy as docker-credential-dexy somewhere on your PATH and point
+docker at it in ~/.docker/config.json:
+
+  "credHelpers": {"registry.mycompany.com": "dexy"}
+
+Registry server URLs are matched against the docker_credentials rules in the
+config to pick a profile.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runDockerCredential(args[0]); err != nil {
+			// Docker shows whatever the helper printed to stdout.
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(dockerCredentialCmd)
+}
+
+// dockerCredentialRule maps registry servers to a profile. Server may be a
+// glob like *.mycompany.com. Token is "id_token" (the default) or
+// "access_token".
+type dockerCredentialRule struct {
+	Server   string `mapstructure:"server"`
+	Profile  string `mapstructure:"profile"`
+	Username string `mapstructure:"username"`
+	Token    string `mapstructure:"token"`
+}
+
+// dockerCredentials is the JSON docker sends to store and expects from get.
+type dockerCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func runDockerCredential(op string) error {
+	switch op {
+	case "get":
+		server, err := readServerURL()
+		if err != nil {
+			return err
+		}
+		rule, ok := matchDockerCredentialRule(server)
+		if !ok {
+			return errors.New(errCredentialsNotFound)
+		}
+		p, err := loadProfile(rule.Profile)
+		if err != nil {
+			return err
+		}
+		tok, err := tokenFor(context.Background(), p)
+		if err != nil {
+			return err
+		}
+		secret := tok.AccessToken
+		if rule.Token == "access_token" {
+			secret = tok.RawAccessToken()
+		}
+		return json.NewEncoder(os.Stdout).Encode(dockerCredentials{
+			ServerURL: server,
+			Username:  rule.Username,
+			Secret:    secret,
+		})
+	case "erase":
+		server, err := readServerURL()
+		if err != nil {
+			return err
+		}
+		rule, ok := matchDockerCredentialRule(server)
+		if !ok {
+			return nil
+		}
+		p, err := loadProfile(rule.Profile)
+		if err != nil {
+			return err
+		}
+		return invalidateAnywhere(p)
+	case "store":
+		// dexy keeps its own cache, there is nothing for docker to store.
+		ioutil.ReadAll(os.Stdin)
+		return nil
+	case "list":
+		servers := map[string]string{}
+		for _, rule := range dockerCredentialRules() {
+			if !strings.Contains(rule.Server, "*") {
+				servers[rule.Server] = rule.Username
+			}
+		}
+		return json.NewEncoder(os.Stdout).Encode(servers)
+	}
+	return fmt.Errorf("unknown docker credential operation %q", op)
+}
+
+func readServerURL() (string, error) {
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	server := strings.TrimSpace(string(b))
+	if server == "" {
+		return "", errors.New("no server URL given")
+	}
+	return server, nil
+}
+
+func dockerCredentialRules() []dockerCredentialRule {
+	var rules []dockerCredentialRule
+	if err := viper.UnmarshalKey("docker_credentials", &rules); err != nil {
+		log.Fatalf("error while reading docker_credentials %v", err)
+	}
+	for i := range rules {
+		if rules[i].Username == "" {
+			rules[i].Username = "dexy"
+		}
+	}
+	return rules
+}
+
+// matchDockerCredentialRule returns the first rule for server.
+func matchDockerCredentialRule(server string) (dockerCredentialRule, bool) {
+	host := registryHost(server)
+	for _, rule := range dockerCredentialRules() {
+		if ok, err := path.Match(registryHost(rule.Server), host); err == nil && ok {
+			return rule, true
+		}
+	}
+	return dockerCredentialRule{}, false
+}
+
+// registryHost reduces the forms docker passes server URLs in, like
+// https://registry.mycompany.com/v1/, to the registry's host.
+func registryHost(server string) string {
+	if i := strings.Index(server, "://"); i >= 0 {
+		server = server[i+3:]
+	}
+	if i := strings.Index(server, "/"); i >= 0 {
+		server = server[:i]
+	}
+	return strings.ToLower(server)
+}
+
+// invokedAs returns the name dexy was run as, without any .exe extension.
+func invokedAs() string {
+	name := filepath.Base(os.Args[0])
+	return strings.TrimSuffix(name, ".exe")
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import "testing"
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		server, want string
+	}{
+		{"registry.example.com", "registry.example.com"},
+		{"Registry.Example.com", "registry.example.com"},
+		{"registry.example.com:5000", "registry.example.com:5000"},
+		{"https://registry.example.com/v1/", "registry.example.com"},
+		{"http://registry.example.com:5000/v2/repo", "registry.example.com:5000"},
+		{"registry.example.com/team/image", "registry.example.com"},
+		{"*.example.com", "*.example.com"},
+	}
+	for _, tt := range tests {
+		if got := registryHost(tt.server); got != tt.want {
+			t.Errorf("registryHost(%q) = %q, want %q", tt.server, got, tt.want)
+		}
+	}
+}
+
+func TestMatchDockerCredentialRule(t *testing.T) {
+	useConfig(t, `docker_credentials:
+  - server: https://registry.example.com/v1/
+    profile: main
+  - server: "*.example.com"
+    profile: wildcard
+    username: oauth2accesstoken
+    token: access_token
+`)
+	tests := []struct {
+		server       string
+		wantProfile  string
+		wantUsername string
+	}{
+		{"registry.example.com", "main", "dexy"},
+		{"https://REGISTRY.example.com/v2/", "main", "dexy"},
+		{"other.example.com", "wildcard", "oauth2accesstoken"},
+		{"registry.example.org", "", ""},
+		{"example.com", "", ""},
+	}
+	for _, tt := range tests {
+		rule, ok := matchDockerCredentialRule(tt.server)
+		if ok != (tt.wantProfile != "") || rule.Profile != tt.wantProfile || rule.Username != tt.wantUsername {
+			t.Errorf("matchDockerCredentialRule(%q) = %+v, %v, want profile %q and username %q",
+				tt.server, rule, ok, tt.wantProfile, tt.wantUsername)
+		}
+	}
+}
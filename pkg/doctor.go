@@ -0,0 +1,416 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// doctorCmd checks everything a login depends on, to explain failures that
+// otherwise end in a single error line.
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the profile's config, provider and token cache for problems",
+	Long: `Check the profile's config, provider and token cache for problems.
+
+doctor shows the profile's settings with secrets redacted, then checks DNS
+and TLS to the issuer, its discovery document and keys, the local clock
+against the provider's, that the callback port is free and that the
+provider accepts the redirect URI, the token cache, and the agent if
+` + agentSockEnv + ` is set. It exits with status 1 if any check fails.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := &doctor{out: os.Stdout}
+		d.run()
+		if d.failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+	addAuthParamFlags(doctorCmd.Flags())
+}
+
+// maxClockSkew is how far the local clock can be from the provider's before
+// tokens may look expired or not yet valid.
+const maxClockSkew = 30 * time.Second
+
+// doctor runs the checks and prints what it finds.
+type doctor struct {
+	out    io.Writer
+	failed bool
+	client *http.Client
+}
+
+func (d *doctor) section(name string) {
+	fmt.Fprintf(d.out, "\n%s\n", name)
+}
+
+func (d *doctor) ok(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "  ok    "+format+"\n", args...)
+}
+
+func (d *doctor) warn(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "  warn  "+format+"\n", args...)
+}
+
+func (d *doctor) fail(format string, args ...interface{}) {
+	d.failed = true
+	fmt.Fprintf(d.out, "  FAIL  "+format+"\n", args...)
+}
+
+func (d *doctor) info(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, "        "+format+"\n", args...)
+}
+
+func (d *doctor) run() {
+	// Don't follow redirects, the authorize check needs to see them.
+	d.client = &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	d.section("config")
+	p := d.checkConfig()
+	if p == nil {
+		return
+	}
+
+	d.section("issuer " + p.Issuer)
+	m := d.checkIssuer(p)
+
+	if p.Grant == dexy.GrantAuthCode && !passwordGrant {
+		d.section("login")
+		d.checkLogin(p, m)
+	}
+
+	d.section("token cache")
+	d.checkCache(p)
+
+	if sock := os.Getenv(agentSockEnv); sock != "" {
+		d.section("agent " + sock)
+		d.checkAgent(p, sock)
+	}
+}
+
+func (d *doctor) checkConfig() *profile {
+	for _, l := range configLayers {
+		if len(l.ignored) > 0 {
+			d.warn("config file %s: ignored %s, its directory isn't in trusted_projects", l.path, strings.Join(l.ignored, ", "))
+		} else {
+			d.ok("config file %s", l.path)
+		}
+	}
+	if len(configLayers) == 0 {
+		d.warn("no config file found, looked for .dexy.yaml in /etc/dexy, $HOME, and the current directory and its parents")
+	}
+	p, err := loadProfile(profileName)
+	if err != nil {
+		d.fail("%v", err)
+		return nil
+	}
+	d.ok("profile %s, from %s", p.Name, p.key)
+
+	for _, v := range profileValues(p.key) {
+		d.info("%s = %s (%s)", v.key, v.value, v.origin)
+	}
+	return p
+}
+
+// checkIssuer checks the network path to the issuer and what it serves,
+// returning its discovery document if it could be fetched.
+func (d *doctor) checkIssuer(p *profile) *dexy.Metadata {
+	u, err := url.Parse(p.Issuer)
+	if err != nil || u.Host == "" {
+		d.fail("dex_host %q is not a URL", p.Issuer)
+		return nil
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+
+	if net.ParseIP(host) == nil {
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			d.fail("dns: %v", err)
+			return nil
+		}
+		d.ok("dns: %s resolves to %s", host, strings.Join(addrs, ", "))
+	}
+
+	switch u.Scheme {
+	case "https":
+		cfg := tlsConfig()
+		cfg.ServerName = host
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", net.JoinHostPort(host, port), cfg)
+		if err != nil {
+			d.fail("tls: %v", err)
+			return nil
+		}
+		state := conn.ConnectionState()
+		conn.Close()
+		cert := state.PeerCertificates[0]
+		d.ok("tls: certificate for %s from %s, valid until %s", cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format(time.RFC3339))
+		if left := time.Until(cert.NotAfter); left < 14*24*time.Hour {
+			d.warn("tls: certificate expires in %s", left.Round(time.Hour))
+		}
+	case "http":
+		d.warn("issuer uses plain http, tokens and secrets are sent unencrypted")
+	default:
+		d.fail("dex_host has unsupported scheme %q", u.Scheme)
+		return nil
+	}
+
+	discoveryURL := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	resp, body, err := d.get(discoveryURL)
+	if err != nil {
+		d.fail("discovery: %v", err)
+		return nil
+	}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		skew := time.Since(date).Round(time.Second)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > maxClockSkew {
+			d.fail("clock: local time is %s off the provider's, tokens may look expired or not yet valid", skew)
+		} else {
+			d.ok("clock: within %s of the provider's", maxClockSkew)
+		}
+	} else {
+		d.warn("clock: provider sent no Date header to compare against")
+	}
+	if resp.StatusCode != http.StatusOK {
+		d.fail("discovery: %s returned %s", discoveryURL, resp.Status)
+		return nil
+	}
+	var m dexy.Metadata
+	if err := json.Unmarshal(body, &m); err != nil {
+		d.fail("discovery: %s is not a discovery document: %v", discoveryURL, err)
+		return nil
+	}
+	d.ok("discovery: %s", discoveryURL)
+	if m.Issuer != p.Issuer {
+		d.fail("discovery: issuer is %q but dex_host is %q, they must match exactly", m.Issuer, p.Issuer)
+	} else {
+		d.ok("discovery: issuer matches dex_host")
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		d.fail("discovery: missing authorization_endpoint, token_endpoint or jwks_uri")
+	}
+	if p.Grant == dexy.GrantClientCredentials && len(m.GrantTypesSupported) > 0 && !contains(m.GrantTypesSupported, dexy.GrantClientCredentials) {
+		d.warn("discovery: client_credentials is not among the supported grants")
+	}
+
+	if m.JWKSURI != "" {
+		d.checkKeys(m.JWKSURI)
+	}
+	return &m
+}
+
+func (d *doctor) checkKeys(jwksURI string) {
+	resp, body, err := d.get(jwksURI)
+	if err != nil {
+		d.fail("keys: %v", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		d.fail("keys: %s returned %s", jwksURI, resp.Status)
+		return
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keys); err != nil {
+		d.fail("keys: %s is not a JWKS: %v", jwksURI, err)
+		return
+	}
+	if len(keys.Keys) == 0 {
+		d.fail("keys: %s has no keys, tokens can't be verified", jwksURI)
+		return
+	}
+	var ids []string
+	for _, k := range keys.Keys {
+		ids = append(ids, fmt.Sprintf("%s (%s)", k.KeyID, k.Algorithm))
+	}
+	d.ok("keys: %s", strings.Join(ids, ", "))
+}
+
+// checkLogin checks the browser can be sent back to dexy after logging in.
+func (d *doctor) checkLogin(p *profile, m *dexy.Metadata) {
+	var redirectURI string
+	switch p.LoginMethod {
+	case loginDevice:
+		if m != nil && m.DeviceAuthorizationEndpoint == "" {
+			d.warn("device login: no device_authorization_endpoint in discovery, assuming dex's %s/device/code", strings.TrimSuffix(p.Issuer, "/"))
+		} else {
+			d.ok("device login: nothing to check locally")
+		}
+		return
+	case loginPaste:
+		redirectURI = dexy.OOBRedirectURL
+	default:
+		host, port := p.CallbackHost, p.CallbackPort
+		if host == "" {
+			host = "localhost"
+		}
+		if port == 0 {
+			port = 10111
+		}
+		redirectURI = fmt.Sprintf("http://%s:%d/oauth2/callback", host, port)
+		if err := checkPortFree(host, port); err != nil {
+			d.fail("callback: %v, or change callback_port", err)
+		} else {
+			d.ok("callback: port %d is free", port)
+		}
+	}
+	if m == nil || m.AuthorizationEndpoint == "" {
+		return
+	}
+	d.checkRedirectURI(p, m.AuthorizationEndpoint, redirectURI)
+}
+
+// checkRedirectURI starts a login and looks at how the provider answers.
+// Providers refuse unregistered redirect URIs with an error page, rather
+// than sending the error to the redirect URI.
+func (d *doctor) checkRedirectURI(p *profile, authEndpoint, redirectURI string) {
+	u, err := url.Parse(authEndpoint)
+	if err != nil {
+		d.fail("redirect URI: authorization_endpoint %q is not a URL", authEndpoint)
+		return
+	}
+	q := u.Query()
+	for k, v := range p.AuthParams {
+		q.Set(k, v)
+	}
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("response_type", "code")
+	q.Set("scope", "openid")
+	q.Set("state", "dexy-doctor")
+	u.RawQuery = q.Encode()
+
+	resp, body, err := d.get(u.String())
+	if err != nil {
+		d.fail("redirect URI: %v", err)
+		return
+	}
+	switch {
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		loc, err := resp.Location()
+		if err == nil && strings.HasPrefix(loc.String(), redirectURI) {
+			if e := loc.Query().Get("error"); e != "" {
+				d.fail("redirect URI: accepted, but the provider refused the login: %s %s", e, loc.Query().Get("error_description"))
+				return
+			}
+		}
+		d.ok("redirect URI: %s accepted", redirectURI)
+	case resp.StatusCode == http.StatusOK:
+		d.ok("redirect URI: %s accepted", redirectURI)
+	default:
+		msg := stripTags(string(body))
+		if len(msg) > 200 {
+			msg = msg[:200] + "..."
+		}
+		if strings.Contains(strings.ToLower(msg), "redirect") {
+			d.fail("redirect URI: %s is not registered for client %s: %s", redirectURI, p.ClientID, msg)
+		} else {
+			d.fail("redirect URI: provider refused a test login with %s: %s", resp.Status, msg)
+		}
+	}
+}
+
+var tagRe = regexp.MustCompile(`<[^>]*>`)
+
+// stripTags boils an HTML error page down to its text.
+func stripTags(s string) string {
+	return strings.Join(strings.Fields(tagRe.ReplaceAllString(s, " ")), " ")
+}
+
+func (d *doctor) checkCache(p *profile) {
+	path := viper.GetString("token_file")
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		d.ok("%s doesn't exist yet, it is created on the first login", path)
+		return
+	}
+	if err != nil {
+		d.fail("%v", err)
+		return
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		d.fail("%s has mode %s, other users can read your tokens, chmod 600 it", path, fi.Mode().Perm())
+	} else {
+		d.ok("%s is only readable by you", path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		d.fail("%v", err)
+		return
+	}
+	var toks map[string]*dexy.Token
+	if err := json.Unmarshal(b, &toks); err != nil {
+		d.fail("%s is corrupt, delete it to start again: %v", path, err)
+		return
+	}
+	d.ok("%s holds %d tokens", path, len(toks))
+
+	tok := toks[p.CacheKey()]
+	switch {
+	case tok == nil:
+		d.info("no token cached for %s", p.CacheKey())
+	case tok.Valid():
+		d.info("token for %s is valid until %s", p.CacheKey(), tok.ExpiryTime.Format(time.RFC3339))
+	case tok.RefreshToken != "":
+		d.info("token for %s has expired, it will be refreshed", p.CacheKey())
+	default:
+		d.info("token for %s has expired, the next use will log in again", p.CacheKey())
+	}
+}
+
+// checkAgent checks the agent other commands get their tokens from.
+func (d *doctor) checkAgent(p *profile, sock string) {
+	resp, err := agentCall(sock, agentRequest{Op: "list"})
+	if err != nil {
+		d.warn("can't reach the agent, commands get tokens themselves instead: %v", err)
+		return
+	}
+	d.ok("agent is running")
+	if contains(resp.Profiles, p.CacheKey()) {
+		d.info("agent holds a valid token for %s", p.CacheKey())
+	} else {
+		d.info("agent holds no token for %s, it gets one on the first request", p.CacheKey())
+	}
+}
+
+// get fetches u, returning at most 1MB of the body.
+func (d *doctor) get(u string) (*http.Response, []byte, error) {
+	resp, err := d.client.Get(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+)
+
+const (
+	grantTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeIDToken   = "urn:ietf:params:oauth:token-type:id_token"
+)
+
+// exchangeOptions are the RFC 8693 request parameters.
+type exchangeOptions struct {
+	subjectToken       string
+	subjectTokenType   string
+	actorToken         string
+	actorTokenType     string
+	requestedTokenType string
+	audiences          []string
+	resources          []string
+	scopes             []string
+}
+
+var exchangeOpts exchangeOptions
+
+// exchangeCmd swaps a token for one minted for another audience or resource
+// using RFC 8693 token exchange.
+var exchangeCmd = &cobra.Command{
+	Use:   "exchange",
+	Short: "Exchange a token for another using RFC 8693 token exchange",
+	Long: `Exchange a subject token for a new token, for example one issued for a
+different audience. The subject token defaults to the profile's own token.
+Use - to read a token from stdin.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := loadProfile(profileName)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		tok, err := exchangeToken(context.Background(), p, exchangeOpts)
+		if err != nil {
+			log.Fatalf("error while exchanging token %v", err)
+		}
+		if err := writeToken(os.Stdout, outputFormat, tok); err != nil {
+			log.Fatalf("error while writing token %v", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exchangeCmd)
+	flags := exchangeCmd.Flags()
+	flags.StringVar(&exchangeOpts.subjectToken, "subject-token", "", "token to exchange (default is the profile's token)")
+	flags.StringVar(&exchangeOpts.subjectTokenType, "subject-token-type", tokenTypeIDToken, "type of the subject token")
+	flags.StringVar(&exchangeOpts.actorToken, "actor-token", "", "token of the party acting on behalf of the subject")
+	flags.StringVar(&exchangeOpts.actorTokenType, "actor-token-type", tokenTypeIDToken, "type of the actor token")
+	flags.StringVar(&exchangeOpts.requestedTokenType, "requested-token-type", "", "type of token to ask for")
+	flags.StringSliceVar(&exchangeOpts.audiences, "audience", nil, "audience the new token is for, may be repeated")
+	flags.StringSliceVar(&exchangeOpts.resources, "resource", nil, "URI of the resource the new token is for, may be repeated")
+	flags.StringSliceVar(&exchangeOpts.scopes, "scope", nil, "scopes to ask for, may be repeated")
+	flags.StringVarP(&outputFormat, "output", "o", outputJSON,
+		fmt.Sprintf("output format, one of %v", outputFormats))
+}
+
+// cacheKey identifies the token an exchange of p's own token asks for. It
+// holds every request parameter but the subject token, which p's cache key
+// stands for, so exchanges differing in any of them are cached separately.
+func (o exchangeOptions) cacheKey(p *profile) string {
+	sorted := func(s []string) []string {
+		s = append([]string(nil), s...)
+		sort.Strings(s)
+		return s
+	}
+	v := url.Values{
+		"subject_token_type":   {o.subjectTokenType},
+		"requested_token_type": {o.requestedTokenType},
+		"audience":             sorted(o.audiences),
+		"resource":             sorted(o.resources),
+		"scope":                sorted(o.scopes),
+	}
+	return p.CacheKey() + "#exchange:" + v.Encode()
+}
+
+func exchangeToken(ctx context.Context, p *profile, o exchangeOptions) (*dexy.Token, error) {
+	// Only cache exchanges of the profile's own token, a token passed on the
+	// command line could belong to anyone.
+	cacheable := o.subjectToken == "" && o.actorToken == ""
+	store := tokenCache()
+	if cacheable {
+		if tok := store.Get(o.cacheKey(p)); tok.Valid() {
+			return tok, nil
+		}
+	}
+
+	subject, err := readTokenArg(o.subjectToken)
+	if err != nil {
+		return nil, err
+	}
+	var loginTime *time.Time
+	if subject == "" {
+		tok, err := tokenFor(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		subject, loginTime = tok.AccessToken, tok.LoginTime
+	}
+	actor, err := readTokenArg(o.actorToken)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+
+	v := url.Values{
+		"grant_type":         {grantTokenExchange},
+		"subject_token":      {subject},
+		"subject_token_type": {o.subjectTokenType},
+	}
+	if actor != "" {
+		v.Set("actor_token", actor)
+		v.Set("actor_token_type", o.actorTokenType)
+	}
+	if o.requestedTokenType != "" {
+		v.Set("requested_token_type", o.requestedTokenType)
+	}
+	if len(o.scopes) > 0 {
+		v.Set("scope", strings.Join(o.scopes, " "))
+	}
+	for _, aud := range o.audiences {
+		v.Add("audience", aud)
+	}
+	for _, res := range o.resources {
+		v.Add("resource", res)
+	}
+
+	oauth2Token, err := c.RequestToken(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	if oauth2Token.AccessToken == "" {
+		return nil, errors.New("token exchange response has no access_token")
+	}
+	tok := &dexy.Token{
+		AccessToken: oauth2Token.AccessToken,
+		ExpiryTime:  oauth2Token.Expiry,
+		LoginTime:   loginTime,
+	}
+	var claims dexy.Claims
+	if tok.ExpiryTime.IsZero() && dexy.UnverifiedClaims(tok.AccessToken, &claims) == nil && claims.Expiry > 0 {
+		tok.ExpiryTime = time.Unix(claims.Expiry, 0)
+	}
+
+	if cacheable {
+		if err := store.Put(o.cacheKey(p), tok); err != nil {
+			return nil, fmt.Errorf("error while attempting to write token to file %v", err)
+		}
+	}
+	return tok, nil
+}
+
+// readTokenArg returns a token given on the command line, reading it from
+// stdin if it is "-".
+func readTokenArg(arg string) (string, error) {
+	if arg != "-" {
+		return arg, nil
+	}
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("error while reading token from stdin %v", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
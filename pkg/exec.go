@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+)
+
+var execOpts struct {
+	tokenEnv      string
+	expiryEnv     string
+	emailEnv      string
+	groupsEnv     string
+	tokenFile     string
+	tokenFileEnv  string
+	refreshBefore time.Duration
+}
+
+// execCmd runs a command with a fresh token in its environment, so tools
+// don't need to be wrapped in shell that calls dexy.
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] -- command [args...]",
+	Short: "Run a command with a token in its environment",
+	Long: `Run a command with a token in its environment.
+
+The token, its expiry and the user's email and groups are put in environment
+variables. With --token-file the token is also written to a file, which is
+rewritten whenever the token is refreshed for as long as the command runs.
+Signals are forwarded to the command and dexy exits with its exit code.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := loadProfile(profileName)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		os.Exit(runExec(p, args))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(execCmd)
+	flags := execCmd.Flags()
+	flags.StringVar(&execOpts.tokenEnv, "token-env", "DEXY_TOKEN", "environment variable to put the token in")
+	flags.StringVar(&execOpts.expiryEnv, "expiry-env", "DEXY_TOKEN_EXPIRY", "environment variable to put the token's expiry in, as RFC 3339")
+	flags.StringVar(&execOpts.emailEnv, "email-env", "DEXY_EMAIL", "environment variable to put the user's email in")
+	flags.StringVar(&execOpts.groupsEnv, "groups-env", "DEXY_GROUPS", "environment variable to put the user's groups in, comma separated")
+	flags.StringVar(&execOpts.tokenFile, "token-file", "", "also write the token to this file, and rewrite it on refresh")
+	flags.StringVar(&execOpts.tokenFileEnv, "token-file-env", "DEXY_TOKEN_FILE", "environment variable to put the token file's path in")
+	flags.DurationVar(&execOpts.refreshBefore, "refresh-before", 2*time.Minute, "how long before expiry to refresh the token file")
+	flags.SetInterspersed(false)
+}
+
+// runExec runs args with a token for p and returns the exit code to use.
+func runExec(p *profile, args []string) int {
+	ctx := context.Background()
+	// The token has to last until the token file's first refresh.
+	p.MinValidity = execOpts.refreshBefore
+	tok, err := tokenFor(ctx, p)
+	if err != nil {
+		log.Fatalf("error while getting token %v", err)
+	}
+
+	env := append(os.Environ(), tokenEnv(tok)...)
+	if execOpts.tokenFile != "" {
+		if err := writeTokenFile(execOpts.tokenFile, tok); err != nil {
+			log.Fatalf("error while writing token file %v", err)
+		}
+		if execOpts.tokenFileEnv != "" {
+			env = append(env, execOpts.tokenFileEnv+"="+execOpts.tokenFile)
+		}
+	}
+
+	child := exec.Command(args[0], args[1:]...)
+	child.Env = env
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+	defer signal.Stop(sigs)
+
+	if err := child.Start(); err != nil {
+		log.Fatalf("error while starting %s %v", args[0], err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				child.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	if execOpts.tokenFile != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refreshTokenFile(p, tok, done)
+		}()
+	}
+
+	err = child.Wait()
+	close(done)
+	wg.Wait()
+	return exitCode(err)
+}
+
+// tokenEnv returns the environment variables describing tok.
+func tokenEnv(tok *dexy.Token) []string {
+	var env []string
+	set := func(name, value string) {
+		if name != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	set(execOpts.tokenEnv, tok.AccessToken)
+	set(execOpts.expiryEnv, tok.ExpiryTime.UTC().Format(time.RFC3339))
+
+	var c dexy.Claims
+	if dexy.UnverifiedClaims(tok.AccessToken, &c) == nil {
+		set(execOpts.emailEnv, c.Email)
+		set(execOpts.groupsEnv, strings.Join(c.Groups, ","))
+	}
+	return env
+}
+
+// refreshTokenFile keeps the token file up to date until done is closed.
+func refreshTokenFile(p *profile, tok *dexy.Token, done chan struct{}) {
+	rp := *p
+	rp.NonInteractive = true
+	rp.MinValidity = execOpts.refreshBefore
+	for {
+		wait := tok.ExpiryTime.Sub(time.Now()) - execOpts.refreshBefore
+		if wait < 10*time.Second {
+			wait = 10 * time.Second
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+
+		next, err := tokenFor(context.Background(), &rp)
+		if err != nil {
+			log.Printf("error while refreshing token %v", err)
+			continue
+		}
+		tok = next
+		if err := writeTokenFile(execOpts.tokenFile, tok); err != nil {
+			log.Printf("error while writing token file %v", err)
+		}
+	}
+}
+
+// writeTokenFile atomically replaces path with the raw token, readable only
+// by the current user.
+func writeTokenFile(path string, tok *dexy.Token) error {
+	return writeFileAtomic(path, []byte(tok.AccessToken), 0600)
+}
+
+// exitCode turns the result of waiting for a child into the exit code dexy
+// should exit with, following the shell convention for signals.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+		if ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return ws.ExitStatus()
+	}
+	return 1
+}
@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	tokenTypeJWT = "urn:ietf:params:oauth:token-type:jwt"
+
+	gcpTokenURL = "https://sts.googleapis.com/v1/token"
+)
+
+// gcpCmd prints the profile's ID token in the format Google's executable
+// sourced credentials expect, for Workload Identity Federation.
+var gcpCmd = &cobra.Command{
+	Use:   "gcp",
+	Short: "Print an ID token as a Google executable-sourced credential",
+	Long: `Print an ID token as a Google executable-sourced credential.
+
+Google client libraries run this as the executable credential source of an
+external_account credential configuration, which "dexy gcp config" writes.
+The GOOGLE_EXTERNAL_ACCOUNT_* environment variables the libraries set are
+respected. Executables must be allowed with
+GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES=1.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		resp := gcpExecutableToken()
+		b, err := json.Marshal(resp)
+		if err != nil {
+			log.Fatalf("error while marshalling response %v", err)
+		}
+		if out := os.Getenv("GOOGLE_EXTERNAL_ACCOUNT_OUTPUT_FILE"); out != "" && resp.Success {
+			if err := ioutil.WriteFile(out, b, 0600); err != nil {
+				log.Printf("error while writing output file %v", err)
+			}
+		}
+		fmt.Println(string(b))
+		if !resp.Success {
+			os.Exit(1)
+		}
+	},
+}
+
+var gcpConfigOpts struct {
+	projectNumber  string
+	pool           string
+	provider       string
+	serviceAccount string
+	outputFile     string
+	timeoutMillis  int
+	write          string
+}
+
+// gcpConfigCmd writes an external_account credential configuration that
+// uses dexy as its executable credential source.
+var gcpConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Write a Google external_account credential configuration that runs dexy",
+	Run: func(cmd *cobra.Command, args []string) {
+		o := gcpConfigOpts
+		if o.projectNumber == "" || o.pool == "" || o.provider == "" {
+			log.Fatalf("--project-number, --pool and --provider are required")
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("error while finding the dexy executable %v", err)
+		}
+		command := shellQuote(exe) + " gcp"
+		if profileName != "" {
+			command += " --profile " + shellQuote(profileName)
+		}
+		if strings.ContainsAny(exe+profileName, " \t\n'\"") {
+			log.Printf("warning: some client libraries split the command on spaces and ignore quotes, install dexy and name the profile without spaces if they can't run it")
+		}
+
+		conf := gcpExternalAccount{
+			Type: "external_account",
+			Audience: fmt.Sprintf("//iam.googleapis.com/projects/%s/locations/global/workloadIdentityPools/%s/providers/%s",
+				o.projectNumber, o.pool, o.provider),
+			SubjectTokenType: tokenTypeIDToken,
+			TokenURL:         gcpTokenURL,
+		}
+		conf.CredentialSource.Executable = gcpExecutable{
+			Command:       command,
+			TimeoutMillis: o.timeoutMillis,
+			OutputFile:    o.outputFile,
+		}
+		if o.serviceAccount != "" {
+			conf.ServiceAccountImpersonationURL = fmt.Sprintf(
+				"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken", o.serviceAccount)
+		}
+
+		b, err := json.MarshalIndent(conf, "", "  ")
+		if err != nil {
+			log.Fatalf("error while marshalling credential configuration %v", err)
+		}
+		if o.write == "" {
+			fmt.Println(string(b))
+			return
+		}
+		if err := ioutil.WriteFile(o.write, append(b, '\n'), 0644); err != nil {
+			log.Fatalf("error while writing credential configuration %v", err)
+		}
+	},
+}
+
+// shellQuote quotes s if it has spaces or quotes, for client libraries that
+// split the command into words like a shell does. Windows paths without
+// spaces are left alone, backslashes and all.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func init() {
+	RootCmd.AddCommand(gcpCmd)
+	gcpCmd.AddCommand(gcpConfigCmd)
+	flags := gcpConfigCmd.Flags()
+	flags.StringVar(&gcpConfigOpts.projectNumber, "project-number", "", "number of the project the workload identity pool is in")
+	flags.StringVar(&gcpConfigOpts.pool, "pool", "", "workload identity pool ID")
+	flags.StringVar(&gcpConfigOpts.provider, "provider", "", "workload identity pool provider ID")
+	flags.StringVar(&gcpConfigOpts.serviceAccount, "service-account", "", "email of a service account to impersonate")
+	flags.StringVar(&gcpConfigOpts.outputFile, "output-file", "", "file the client libraries should cache the token in")
+	flags.IntVar(&gcpConfigOpts.timeoutMillis, "timeout-millis", 30000, "how long the client libraries should wait for dexy")
+	flags.StringVar(&gcpConfigOpts.write, "write", "", "write the configuration to this file instead of stdout")
+}
+
+type gcpExternalAccount struct {
+	Type                           string `json:"type"`
+	Audience                       string `json:"audience"`
+	SubjectTokenType               string `json:"subject_token_type"`
+	TokenURL                       string `json:"token_url"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url,omitempty"`
+	CredentialSource               struct {
+		Executable gcpExecutable `json:"executable"`
+	} `json:"credential_source"`
+}
+
+type gcpExecutable struct {
+	Command       string `json:"command"`
+	TimeoutMillis int    `json:"timeout_millis,omitempty"`
+	OutputFile    string `json:"output_file,omitempty"`
+}
+
+// gcpExecutableResponse is the executable-sourced credential response.
+type gcpExecutableResponse struct {
+	Version        int    `json:"version"`
+	Success        bool   `json:"success"`
+	TokenType      string `json:"token_type,omitempty"`
+	IDToken        string `json:"id_token,omitempty"`
+	ExpirationTime int64  `json:"expiration_time,omitempty"`
+	Code           string `json:"code,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+func gcpError(code, format string, args ...interface{}) *gcpExecutableResponse {
+	return &gcpExecutableResponse{
+		Version: 1,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func gcpExecutableToken() *gcpExecutableResponse {
+	tokenType := os.Getenv("GOOGLE_EXTERNAL_ACCOUNT_TOKEN_TYPE")
+	switch tokenType {
+	case "":
+		tokenType = tokenTypeIDToken
+	case tokenTypeIDToken, tokenTypeJWT:
+	default:
+		return gcpError("UNSUPPORTED_TOKEN_TYPE", "dexy can't provide tokens of type %s", tokenType)
+	}
+
+	p, err := loadProfile(profileName)
+	if err != nil {
+		return gcpError("INVALID_CONFIG", "%v", err)
+	}
+	// A profile can be pinned to one workload identity provider, so its
+	// tokens aren't handed to a configuration meant for another.
+	want := viper.GetString(p.key + ".gcp.audience")
+	if got := os.Getenv("GOOGLE_EXTERNAL_ACCOUNT_AUDIENCE"); want != "" && got != "" && got != want {
+		return gcpError("INVALID_AUDIENCE", "profile %s is for %s, not %s", p.Name, want, got)
+	}
+	// Only log the user in if the client library says there is someone
+	// there to do it.
+	if os.Getenv("GOOGLE_EXTERNAL_ACCOUNT_INTERACTIVE") == "0" {
+		p.NonInteractive = true
+	}
+	tok, err := tokenFor(context.Background(), p)
+	if err != nil {
+		code := "TOKEN_ERROR"
+		// Errors from the agent only carry the message.
+		if strings.Contains(err.Error(), dexy.ErrLoginRequired.Error()) {
+			code = "LOGIN_REQUIRED"
+		}
+		return gcpError(code, "%v", err)
+	}
+	return &gcpExecutableResponse{
+		Version:        1,
+		Success:        true,
+		TokenType:      tokenType,
+		IDToken:        tok.AccessToken,
+		ExpirationTime: tok.ExpiryTime.Unix(),
+	}
+}
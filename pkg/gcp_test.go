@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGCPExecutableToken(t *testing.T) {
+	const wif = "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/dexy/providers/dexy"
+	tests := []struct {
+		name     string
+		profile  string
+		env      map[string]string
+		wantCode string
+		wantType string
+	}{
+		{"default type", "", nil, "", tokenTypeIDToken},
+		{"jwt", "", map[string]string{"GOOGLE_EXTERNAL_ACCOUNT_TOKEN_TYPE": tokenTypeJWT}, "", tokenTypeJWT},
+		{"saml", "", map[string]string{"GOOGLE_EXTERNAL_ACCOUNT_TOKEN_TYPE": "urn:ietf:params:oauth:token-type:saml2"}, "UNSUPPORTED_TOKEN_TYPE", ""},
+		{"matching audience", "", map[string]string{"GOOGLE_EXTERNAL_ACCOUNT_AUDIENCE": wif}, "", tokenTypeIDToken},
+		{"other audience", "", map[string]string{"GOOGLE_EXTERNAL_ACCOUNT_AUDIENCE": wif + "-other"}, "INVALID_AUDIENCE", ""},
+		{"no such profile", "missing", nil, "INVALID_CONFIG", ""},
+		{"wrong secret", "badsecret", nil, "TOKEN_ERROR", ""},
+		{"user not logged in", "user", map[string]string{"GOOGLE_EXTERNAL_ACCOUNT_INTERACTIVE": "0"}, "LOGIN_REQUIRED", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss := useIssuer(t, "    gcp:\n      audience: "+wif+"\n")
+			iss.Clients = map[string]string{"ci": "s3cret", "dexy": ""}
+			viper.Set("profiles.badsecret.dex_host", iss.URL)
+			viper.Set("profiles.badsecret.grant", "client_credentials")
+			viper.Set("profiles.badsecret.client_id", "ci")
+			viper.Set("profiles.badsecret.client_secret", "wrong")
+			viper.Set("profiles.user.dex_host", iss.URL)
+			viper.Set("profiles.user.client_id", "dexy")
+			profileName = tt.profile
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			resp := gcpExecutableToken()
+			if resp.Version != 1 {
+				t.Errorf("version %d, want 1", resp.Version)
+			}
+			if tt.wantCode != "" {
+				if resp.Success || resp.Code != tt.wantCode || resp.Message == "" {
+					t.Errorf("got %+v, want error %s", resp, tt.wantCode)
+				}
+				return
+			}
+			if !resp.Success || resp.TokenType != tt.wantType || resp.IDToken == "" || resp.ExpirationTime == 0 {
+				t.Errorf("got %+v, want a %s", resp, tt.wantType)
+			}
+		})
+	}
+}
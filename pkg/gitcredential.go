@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// gitCredentialCmd implements git's credential helper protocol, so git can
+// use the profile's token as an HTTP password.
+var gitCredentialCmd = &cobra.Command{
+	Use:   "git-credential get|store|erase",
+	Short: "Git credential helper that uses dexy tokens as passwords",
+	Long: `Git credential helper that uses dexy tokens as passwords.
+
+Set it up with:
+
+  git config --global credential.https://git.mycompany.com.helper "dexy git-credential"
+
+The request git sends on stdin is matched against the git_credentials rules
+in the config to pick a profile, unless --profile is given. get prints a
+username and the current token as the password, erase throws away a cached
+token git reports was rejected, and store does nothing.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req, err := readGitCredential(os.Stdin)
+		if err != nil {
+			log.Fatalf("error while reading credential request %v", err)
+		}
+		rule, ok := matchGitCredentialRule(req)
+		if !ok {
+			// Not ours, leave it to git's other helpers.
+			return
+		}
+		p, err := loadProfile(rule.Profile)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+
+		switch args[0] {
+		case "get":
+			tok, err := tokenFor(context.Background(), p)
+			if err != nil {
+				log.Fatalf("error while getting token %v", err)
+			}
+			fmt.Printf("username=%s\n", rule.Username)
+			fmt.Printf("password=%s\n", tok.AccessToken)
+			fmt.Printf("password_expiry_utc=%d\n", tok.ExpiryTime.Unix())
+		case "erase":
+			if err := invalidateAnywhere(p); err != nil {
+				log.Fatalf("error while invalidating token %v", err)
+			}
+		case "store":
+			// dexy keeps its own cache, there is nothing for git to store.
+		default:
+			log.Fatalf("unknown git credential operation %q", args[0])
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(gitCredentialCmd)
+}
+
+// gitCredentialRule maps the repositories a credential request is for to a
+// profile. Empty fields match anything, and Path is a glob.
+type gitCredentialRule struct {
+	Protocol string `mapstructure:"protocol"`
+	Host     string `mapstructure:"host"`
+	Path     string `mapstructure:"path"`
+	Profile  string `mapstructure:"profile"`
+	Username string `mapstructure:"username"`
+}
+
+func (r gitCredentialRule) matches(req map[string]string) bool {
+	if r.Protocol != "" && r.Protocol != req["protocol"] {
+		return false
+	}
+	if r.Host != "" && !strings.EqualFold(r.Host, req["host"]) {
+		return false
+	}
+	if r.Path != "" {
+		ok, err := path.Match(r.Path, req["path"])
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchGitCredentialRule returns the first rule matching req. If --profile
+// was given it is used for every request.
+func matchGitCredentialRule(req map[string]string) (gitCredentialRule, bool) {
+	if profileName != "" {
+		return gitCredentialRule{Profile: profileName, Username: "dexy"}, true
+	}
+	var rules []gitCredentialRule
+	if err := viper.UnmarshalKey("git_credentials", &rules); err != nil {
+		log.Fatalf("error while reading git_credentials %v", err)
+	}
+	for _, rule := range rules {
+		if rule.matches(req) {
+			if rule.Username == "" {
+				rule.Username = "dexy"
+			}
+			return rule, true
+		}
+	}
+	return gitCredentialRule{}, false
+}
+
+// readGitCredential reads the key=value lines git sends, up to a blank line
+// or the end of input.
+func readGitCredential(r io.Reader) (map[string]string, error) {
+	req := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("malformed line %q", line)
+		}
+		req[line[:i]] = line[i+1:]
+	}
+	return req, scanner.Err()
+}
+
+// invalidateAnywhere throws away p's cached token, in the agent as well if
+// one is running.
+func invalidateAnywhere(p *profile) error {
+	if sock := os.Getenv(agentSockEnv); sock != "" {
+		_, err := agentCall(sock, agentRequest{Op: "invalidate", Profile: p.Name, Audience: p.Audience, Settings: p.settingsDigest()})
+		if _, ok := err.(agentError); ok && err != errAgentSettings {
+			return err
+		}
+		if err != nil {
+			log.Printf("warning: could not reach dexy agent at %s, continuing without it: %v", sock, err)
+		}
+	}
+	return invalidateToken(p)
+}
@@ -0,0 +1,437 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var initOpts struct {
+	nonInteractive  bool
+	name            string
+	issuer          string
+	email           string
+	webfingerServer string
+	clientID        string
+	clientSecret    string
+	scopes          []string
+	login           string
+	callbackHost    string
+	callbackPort    int
+}
+
+// initCmd sets up a profile by asking for its settings, checking them
+// against the provider as it goes.
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Set up a profile, asking for its settings",
+	Long: `Set up a profile, asking for its settings.
+
+dexy fetches the issuer's discovery document to show what it supports, asks
+for the client's details, checks the callback port is free and then adds
+the profile, with comments, to the config file. Every question has a flag,
+and with --non-interactive the flags are used without asking:
+
+  dexy init --non-interactive --name work --issuer https://dex.mycompany.com \
+    --client-id dexy --scopes email,groups`,
+	Run: func(cmd *cobra.Command, args []string) {
+		q := &questions{ask: !initOpts.nonInteractive}
+		s, err := q.profileSettings(context.Background())
+		if err != nil {
+			log.Fatalf("error while setting up profile %v", err)
+		}
+		makeDefault := s.name != defaultProfile && !viper.IsSet("profile") && !viper.IsSet("auth")
+		path, err := addProfileToConfig(s.name, renderProfile(s), makeDefault)
+		if err != nil {
+			log.Fatalf("error while saving profile %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "\nSaved profile %s in %s\n", s.name, path)
+		if s.login == loginBrowser {
+			fmt.Fprintf(os.Stderr, "Make sure %s is a redirect URI of client %s\n", s.redirectURI(), s.clientID)
+		}
+		fmt.Fprintf(os.Stderr, "Try it with: dexy login --profile %s\n", s.name)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(initCmd)
+	flags := initCmd.Flags()
+	flags.BoolVar(&initOpts.nonInteractive, "non-interactive", false, "don't ask anything, use the flags and defaults")
+	flags.StringVar(&initOpts.name, "name", "", "name of the profile (default is default)")
+	flags.StringVar(&initOpts.issuer, "issuer", "", "issuer URL of the provider")
+	flags.StringVar(&initOpts.email, "email", "", "find the issuer from this email address with WebFinger, and use it as the login_hint")
+	flags.StringVar(&initOpts.webfingerServer, "webfinger-server", "", "URL to ask for the issuer of --email (default is https:// and the email's domain)")
+	flags.StringVar(&initOpts.clientID, "client-id", "", "client ID registered with the provider (default is dexy)")
+	flags.StringVar(&initOpts.clientSecret, "client-secret", "", "client secret, if the client has one")
+	flags.StringSliceVar(&initOpts.scopes, "scopes", nil, "scopes to ask for besides openid (default is the supported ones of email, groups and offline_access)")
+	flags.StringVar(&initOpts.login, "login", "", "how to log in, one of browser, device or paste (default is browser)")
+	flags.StringVar(&initOpts.callbackHost, "callback-host", "", "host of the browser login's redirect URI (default is localhost)")
+	flags.IntVar(&initOpts.callbackPort, "callback-port", 0, "port the browser login listens on (default is 10111)")
+}
+
+// initSettings are the answers init writes into the profile.
+type initSettings struct {
+	name         string
+	issuer       string
+	email        string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	login        string
+	callbackHost string
+	callbackPort int
+}
+
+func (s *initSettings) redirectURI() string {
+	return fmt.Sprintf("http://%s:%d/oauth2/callback", s.callbackHost, s.callbackPort)
+}
+
+// questions asks for settings on the terminal, or with ask false just
+// takes the defaults.
+type questions struct {
+	ask bool
+}
+
+func (q *questions) question(prompt, def string) (string, error) {
+	if !q.ask {
+		return def, nil
+	}
+	if def != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", prompt, def)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	}
+	answer, err := readLine(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("error while reading answer %v", err)
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+func (q *questions) secret(prompt, def string) (string, error) {
+	if !q.ask || !isTerminal(int(os.Stdin.Fd())) {
+		return q.question(prompt, def)
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	answer, err := readPassword(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("error while reading answer %v", err)
+	}
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// until asks again while check rejects the answer. Without asking there is
+// no second chance, so the first rejection is the error.
+func (q *questions) until(prompt, def string, check func(string) error) (string, error) {
+	for {
+		answer, err := q.question(prompt, def)
+		if err != nil {
+			return "", err
+		}
+		err = check(answer)
+		if err == nil {
+			return answer, nil
+		}
+		if !q.ask {
+			return "", err
+		}
+		fmt.Fprintf(os.Stderr, "  %v\n", err)
+	}
+}
+
+var profileNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func (q *questions) profileSettings(ctx context.Context) (*initSettings, error) {
+	s := &initSettings{email: initOpts.email}
+	var err error
+
+	s.name, err = q.until("Profile name", firstNonEmpty(initOpts.name, defaultProfile), func(name string) error {
+		if !profileNameRe.MatchString(name) {
+			return fmt.Errorf("%q is not a valid profile name, use letters, digits, - and _", name)
+		}
+		if viper.IsSet("profiles."+name) || (name == defaultProfile && viper.IsSet("auth")) {
+			return fmt.Errorf("there is already a profile named %q", name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := initOpts.issuer
+	if issuer == "" && s.email != "" {
+		if issuer, err = dexy.DiscoverIssuer(ctx, s.email, initOpts.webfingerServer); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Found issuer %s for %s\n", issuer, s.email)
+	}
+	var m *dexy.Metadata
+	s.issuer, err = q.until("Issuer URL", issuer, func(issuer string) error {
+		if issuer == "" {
+			return fmt.Errorf("an issuer URL is needed, set --issuer or --email")
+		}
+		if err := orgPolicy.checkIssuer(issuer); err != nil {
+			return err
+		}
+		var err error
+		m, err = dexy.Discover(issuer)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	describeProvider(m)
+
+	s.clientID, err = q.until("Client ID", firstNonEmpty(initOpts.clientID, "dexy"), func(clientID string) error {
+		return orgPolicy.checkClientID(clientID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.clientSecret, err = q.secret("Client secret (empty for none)", initOpts.clientSecret); err != nil {
+		return nil, err
+	}
+	if s.clientSecret != "" {
+		key := "profiles." + s.name + ".client_secret"
+		if err := orgPolicy.checkSave(map[string]interface{}{key: s.clientSecret}); err != nil {
+			return nil, fmt.Errorf("%v, leave it empty and set %s", err, envName(key))
+		}
+	}
+	if s.clientSecret == "" && len(m.TokenEndpointAuthMethodsSupported) > 0 && !contains(m.TokenEndpointAuthMethodsSupported, "none") {
+		fmt.Fprintln(os.Stderr, "  warning: the provider doesn't list public clients (auth method none) as supported")
+	}
+
+	scopes := initOpts.scopes
+	if len(scopes) == 0 {
+		for _, sc := range []string{"email", "groups", "offline_access"} {
+			if len(m.ScopesSupported) == 0 || contains(m.ScopesSupported, sc) {
+				scopes = append(scopes, sc)
+			}
+		}
+	}
+	answer, err := q.question("Scopes besides openid", strings.Join(scopes, " "))
+	if err != nil {
+		return nil, err
+	}
+	s.scopes = strings.FieldsFunc(answer, func(r rune) bool { return r == ' ' || r == ',' })
+
+	s.login, err = q.until("Login method (browser, device or paste)", firstNonEmpty(initOpts.login, loginBrowser), func(login string) error {
+		switch login {
+		case loginBrowser, loginPaste:
+		case loginDevice:
+			if m.DeviceAuthorizationEndpoint == "" && len(m.GrantTypesSupported) > 0 && !contains(m.GrantTypesSupported, dexy.GrantDeviceCode) {
+				return fmt.Errorf("the provider doesn't support the device login")
+			}
+		default:
+			return fmt.Errorf("unknown login %q, must be browser, device or paste", login)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.login != loginBrowser {
+		return s, nil
+	}
+
+	if s.callbackHost, err = q.question("Callback host", firstNonEmpty(initOpts.callbackHost, "localhost")); err != nil {
+		return nil, err
+	}
+	port := 10111
+	if initOpts.callbackPort != 0 {
+		port = initOpts.callbackPort
+	}
+	answer, err = q.until("Callback port", strconv.Itoa(port), func(answer string) error {
+		port, err := strconv.Atoi(answer)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("%q is not a port number", answer)
+		}
+		return checkPortFree(s.callbackHost, port)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.callbackPort, _ = strconv.Atoi(answer)
+	return s, nil
+}
+
+// describeProvider shows what the provider supports, to help answer the
+// questions after it.
+func describeProvider(m *dexy.Metadata) {
+	list := func(vals []string) string {
+		if len(vals) == 0 {
+			return "(not listed)"
+		}
+		return strings.Join(vals, ", ")
+	}
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	fmt.Fprintf(os.Stderr, "\nThe provider at %s supports:\n", m.Issuer)
+	fmt.Fprintf(os.Stderr, "  grants:              %s\n", list(m.GrantTypesSupported))
+	fmt.Fprintf(os.Stderr, "  scopes:              %s\n", list(m.ScopesSupported))
+	fmt.Fprintf(os.Stderr, "  client auth methods: %s\n", list(m.TokenEndpointAuthMethodsSupported))
+	fmt.Fprintf(os.Stderr, "  device login:        %s\n", yesNo(m.DeviceAuthorizationEndpoint != "" || contains(m.GrantTypesSupported, dexy.GrantDeviceCode)))
+	fmt.Fprintf(os.Stderr, "  client registration: %s\n\n", yesNo(m.RegistrationEndpoint != ""))
+}
+
+// checkPortFree checks the browser login will be able to listen on host and
+// port.
+func checkPortFree(host string, port int) error {
+	ln, err := dexy.ListenCallback(host, port)
+	if err != nil {
+		return fmt.Errorf("port %d is in use, pick another", port)
+	}
+	return ln.Close()
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// yamlValue formats v as a YAML scalar or flow sequence.
+func yamlValue(v interface{}) string {
+	if vals, ok := v.([]string); ok {
+		quoted := make([]string, len(vals))
+		for i, s := range vals {
+			quoted[i] = yamlValue(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	b, _ := yaml.Marshal(v)
+	return strings.TrimSpace(string(b))
+}
+
+// renderProfile writes s as a commented profile, indented to go under the
+// profiles key. It is indented with two spaces, which addProfileToConfig
+// adjusts to match the file.
+func renderProfile(s *initSettings) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "  # Added by dexy init on %s.\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintf(&b, "  %s:\n", s.name)
+	fmt.Fprintf(&b, "    # dexy finds the provider's endpoints from the issuer's discovery document.\n")
+	fmt.Fprintf(&b, "    dex_host: %s\n", yamlValue(s.issuer))
+	fmt.Fprintf(&b, "    # The client registered with the provider for dexy.\n")
+	fmt.Fprintf(&b, "    client_id: %s\n", yamlValue(s.clientID))
+	if s.clientSecret != "" {
+		fmt.Fprintf(&b, "    client_secret: %s\n", yamlValue(s.clientSecret))
+	}
+	fmt.Fprintf(&b, "    # Scopes to ask for besides openid. offline_access gets a refresh token.\n")
+	fmt.Fprintf(&b, "    scopes: %s\n", yamlValue(s.scopes))
+	fmt.Fprintf(&b, "    # How to log in: browser, device or paste.\n")
+	fmt.Fprintf(&b, "    login: %s\n", s.login)
+	if s.login == loginBrowser {
+		fmt.Fprintf(&b, "    # The browser login listens here for the redirect back from the provider,\n")
+		fmt.Fprintf(&b, "    # so %s must be a redirect URI of the client.\n", s.redirectURI())
+		fmt.Fprintf(&b, "    callback_host: %s\n", yamlValue(s.callbackHost))
+		fmt.Fprintf(&b, "    callback_port: %d\n", s.callbackPort)
+	}
+	if s.email != "" {
+		fmt.Fprintf(&b, "    auth_params:\n")
+		fmt.Fprintf(&b, "      # Fills in who is logging in on the provider's login page.\n")
+		fmt.Fprintf(&b, "      login_hint: %s\n", yamlValue(s.email))
+	}
+	return b.String()
+}
+
+var (
+	profilesKeyRe = regexp.MustCompile(`^profiles:\s*(#.*)?$`)
+	indentRe      = regexp.MustCompile(`^(\s+)\S`)
+)
+
+// addProfileToConfig adds a rendered profile under the profiles key of the
+// config file, leaving the rest of the file and its comments alone. With
+// makeDefault the profile is also made the default.
+func addProfileToConfig(name, block string, makeDefault bool) (string, error) {
+	path, old, err := readConfigFile()
+	if err != nil {
+		return "", err
+	}
+	lines := strings.SplitAfter(string(old), "\n")
+	if n := len(lines); n > 0 && lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+	if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		lines[n-1] += "\n"
+	}
+
+	at := -1
+	for i, line := range lines {
+		if profilesKeyRe.MatchString(strings.TrimRight(line, "\r\n")) {
+			at = i
+			break
+		}
+		if strings.HasPrefix(line, "profiles:") {
+			return "", fmt.Errorf("can't add to the profiles in %s, they aren't a block mapping", path)
+		}
+	}
+
+	var out bytes.Buffer
+	if makeDefault {
+		fmt.Fprintf(&out, "profile: %s\n", name)
+	}
+	if at < 0 {
+		out.WriteString(strings.Join(lines, ""))
+		if len(lines) > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString("profiles:\n")
+		out.WriteString(block)
+	} else {
+		// Indent the profile like the ones already there.
+		indent := "  "
+		for _, line := range lines[at+1:] {
+			if m := indentRe.FindStringSubmatch(line); m != nil && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				indent = m[1]
+				break
+			}
+		}
+		out.WriteString(strings.Join(lines[:at+1], ""))
+		for _, line := range strings.SplitAfter(block, "\n") {
+			trimmed := strings.TrimLeft(line, " ")
+			levels := (len(line) - len(trimmed)) / 2
+			out.WriteString(strings.Repeat(indent, levels) + trimmed)
+		}
+		out.WriteString(strings.Join(lines[at+1:], ""))
+	}
+
+	// Make sure the result still parses and has the profile where dexy
+	// will look for it, rather than breaking the config.
+	var doc struct {
+		Profiles map[string]interface{} `yaml:"profiles"`
+	}
+	if err := yaml.Unmarshal(out.Bytes(), &doc); err != nil {
+		return "", fmt.Errorf("adding the profile would break %s: %v", path, err)
+	}
+	if _, ok := doc.Profiles[name]; !ok {
+		return "", fmt.Errorf("adding the profile to %s didn't work, add it by hand:\n%s", path, block)
+	}
+
+	return path, writeFileAtomic(path, out.Bytes(), 0600)
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var loginOpts struct {
+	webfingerServer string
+	clientID        string
+	clientSecret    string
+}
+
+// loginCmd logs in to a profile, or with an email address, finds the
+// user's issuer and sets up a profile for it first.
+var loginCmd = &cobra.Command{
+	Use:   "login [email]",
+	Short: "Log in, setting up a profile for an email address's issuer if needed",
+	Long: `Log in to the profile, even if it has a cached token.
+
+Given an email address, dexy finds its issuer with OpenID Connect WebFinger
+discovery on the address's domain. Unless --profile says otherwise, the
+profile is named after the domain, and it is created if it doesn't exist,
+with the address as its login_hint. The first profile created this way
+becomes the default.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		var email string
+		if len(args) == 1 {
+			email = args[0]
+			if err := profileForEmail(ctx, email); err != nil {
+				log.Fatalf("error while setting up profile %v", err)
+			}
+		}
+		p, err := loadProfile(profileName)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		p.ForceLogin = true
+		if email != "" {
+			p.AuthParams["login_hint"] = email
+		}
+		tok, err := getToken(ctx, p)
+		if err != nil {
+			log.Fatalf("error while logging in %v", err)
+		}
+		var claims dexy.Claims
+		dexy.UnverifiedClaims(tok.AccessToken, &claims)
+		who := claims.Email
+		if who == "" {
+			who = claims.Subject
+		}
+		fmt.Fprintf(os.Stderr, "Logged in to profile %s as %s\n", p.Name, who)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(loginCmd)
+	flags := loginCmd.Flags()
+	flags.StringVar(&loginOpts.webfingerServer, "webfinger-server", "", "URL to ask for the issuer (default is https:// and the email's domain)")
+	flags.StringVar(&loginOpts.clientID, "client-id", "dexy", "client ID for a new profile")
+	flags.StringVar(&loginOpts.clientSecret, "client-secret", "", "client secret for a new profile")
+	flags.BoolVar(&passwordGrant, "password-grant", false,
+		"log in with a username and password instead of a browser, the profile must set password_grant: true")
+	addAuthParamFlags(flags)
+}
+
+// profileForEmail makes sure there is a profile for email's issuer, and
+// selects it. The profile is named with --profile, or after the domain.
+func profileForEmail(ctx context.Context, email string) error {
+	issuer, err := dexy.DiscoverIssuer(ctx, email, loginOpts.webfingerServer)
+	if err != nil {
+		return err
+	}
+	if err := orgPolicy.checkIssuer(issuer); err != nil {
+		return err
+	}
+	if profileName == "" {
+		domain := email[strings.LastIndex(email, "@")+1:]
+		profileName = strings.Replace(domain, ".", "-", -1)
+	}
+	name, key, ok := profileKey(profileName)
+	if !ok {
+		key = "profiles." + name
+	}
+
+	if existing := viper.GetString(key + ".dex_host"); existing != "" {
+		if existing != issuer {
+			return fmt.Errorf("profile %q is for %s, but %s logs in at %s, use --profile to pick another", name, existing, email, issuer)
+		}
+		return nil
+	}
+
+	values := map[string]interface{}{
+		key + ".dex_host":               issuer,
+		key + ".auth_params.login_hint": email,
+	}
+	if viper.GetString(key+".client_id") == "" {
+		values[key+".client_id"] = loginOpts.clientID
+	}
+	if loginOpts.clientSecret != "" {
+		values[key+".client_secret"] = loginOpts.clientSecret
+	}
+	if key != "auth" && !viper.IsSet("profile") && !viper.IsSet("auth") {
+		values["profile"] = name
+	}
+	path, err := updateConfig(values)
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		viper.Set(k, v)
+	}
+	fmt.Fprintf(os.Stderr, "Found issuer %s for %s, saved profile %s in %s\n", issuer, email, name, path)
+	return nil
+}
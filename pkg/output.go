@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+)
+
+var outputFormat string
+
+const (
+	outputJSON           = "json"
+	outputToken          = "token"
+	outputExecCredential = "exec-credential"
+)
+
+var outputFormats = []string{outputJSON, outputToken, outputExecCredential}
+
+// execCredential is the client.authentication.k8s.io ExecCredential that
+// kubectl expects from an exec credential plugin.
+type execCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Status     execCredentialStatus `json:"status"`
+}
+
+type execCredentialStatus struct {
+	Token               string `json:"token"`
+	ExpirationTimestamp string `json:"expirationTimestamp,omitempty"`
+}
+
+// writeToken prints tok to w in the given format.
+func writeToken(w io.Writer, format string, tok *dexy.Token) error {
+	switch format {
+	case "", outputJSON:
+		b, err := json.Marshal(&dexy.Token{
+			AccessToken: tok.AccessToken,
+			ExpiryTime:  tok.ExpiryTime,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case outputToken:
+		_, err := fmt.Fprintln(w, tok.AccessToken)
+		return err
+	case outputExecCredential:
+		cred := execCredential{
+			APIVersion: "client.authentication.k8s.io/v1beta1",
+			Kind:       "ExecCredential",
+			Status: execCredentialStatus{
+				Token:               tok.AccessToken,
+				ExpirationTimestamp: tok.ExpiryTime.UTC().Format(time.RFC3339),
+			},
+		}
+		b, err := json.Marshal(cred)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+	return fmt.Errorf("unknown output format %q, must be one of %v", format, outputFormats)
+}
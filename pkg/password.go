@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var passwordGrant bool
+
+// passwordCredentials gets the username and password from DEXY_USERNAME and
+// DEXY_PASSWORD, then from stdin (one per line) if it isn't a terminal, and
+// otherwise prompts for them on the terminal without echoing the password.
+func passwordCredentials(p *profile) (string, string, error) {
+	username := os.Getenv("DEXY_USERNAME")
+	if username == "" {
+		username = p.Username
+	}
+	password := os.Getenv("DEXY_PASSWORD")
+	if username != "" && password != "" {
+		return username, password, nil
+	}
+
+	if !isTerminal(int(os.Stdin.Fd())) {
+		var err error
+		if username == "" {
+			if username, err = readLine(os.Stdin); err != nil {
+				return "", "", fmt.Errorf("error while reading username from stdin %v", err)
+			}
+		}
+		if password == "" {
+			if password, err = readLine(os.Stdin); err != nil {
+				return "", "", fmt.Errorf("error while reading password from stdin %v", err)
+			}
+		}
+		return username, password, nil
+	}
+
+	if username == "" {
+		fmt.Fprint(os.Stderr, "Username: ")
+		u, err := readLine(os.Stdin)
+		if err != nil {
+			return "", "", fmt.Errorf("error while reading username %v", err)
+		}
+		username = u
+	}
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		pw, err := readPassword(os.Stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", "", fmt.Errorf("error while reading password %v", err)
+		}
+		password = pw
+	}
+	return username, password, nil
+}
+
+// readLine reads a single line from r a byte at a time, so nothing past the
+// newline is consumed.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r"), nil
+}
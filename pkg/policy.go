@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// policy is what an administrator allows dexy to do, read from policyFile.
+// It isn't part of the config, so nothing a user sets can override it.
+type policy struct {
+	// AllowedIssuers and AllowedClientIDs, if set, are the only issuers and
+	// client IDs profiles can use.
+	AllowedIssuers   []string `yaml:"allowed_issuers"`
+	AllowedClientIDs []string `yaml:"allowed_client_ids"`
+
+	// RequirePKCE turns on PKCE for every profile.
+	RequirePKCE bool `yaml:"require_pkce"`
+
+	// MinTLSVersion is the lowest TLS version dexy connects with, such as
+	// "1.2". Setting it also rules out issuers on plain http.
+	MinTLSVersion string `yaml:"min_tls_version"`
+
+	// ForbidInsecureSkipVerify stops dexy from ever skipping verification
+	// of a server's certificate, even when asked to with VAULT_SKIP_VERIFY
+	// or --insecure-skip-verify.
+	ForbidInsecureSkipVerify bool `yaml:"forbid_insecure_skip_verify"`
+
+	// ForbidPlaintextSecrets keeps client secrets and other credentials out
+	// of config files, they must come from the environment or flags.
+	ForbidPlaintextSecrets bool `yaml:"forbid_plaintext_secrets"`
+
+	// MaxCacheLifetime is how long after a login its tokens can be used from
+	// the cache, refresh tokens included.
+	MaxCacheLifetime time.Duration `yaml:"max_cache_lifetime"`
+
+	// minTLS is MinTLSVersion as a crypto/tls version.
+	minTLS uint16
+}
+
+// orgPolicy is the policy dexy enforces, empty if there is no policy file.
+var orgPolicy policy
+
+// tlsVersions are the versions min_tls_version accepts.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadPolicy reads the policy file, if there is one, and applies the rules
+// that hold for every connection.
+func loadPolicy() error {
+	b, err := ioutil.ReadFile(policyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(b, &orgPolicy); err != nil {
+		return fmt.Errorf("cannot parse %s %v", policyFile, err)
+	}
+	if orgPolicy.MinTLSVersion != "" {
+		v, ok := tlsVersions[orgPolicy.MinTLSVersion]
+		if !ok {
+			return fmt.Errorf("%s has unknown min_tls_version %q, must be 1.0, 1.1, 1.2 or 1.3", policyFile, orgPolicy.MinTLSVersion)
+		}
+		orgPolicy.minTLS = v
+	}
+	// Everything in dexy talks HTTP with the default transport, unless it
+	// gets one from insecureTransport.
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.TLSClientConfig = tlsConfig()
+	}
+	return nil
+}
+
+// tlsConfig returns the settings for any TLS connection dexy makes, so
+// connections that don't use the default transport follow the policy too.
+func tlsConfig() *tls.Config {
+	return &tls.Config{MinVersion: orgPolicy.minTLS}
+}
+
+// insecureTransport returns a transport that doesn't verify the
+// certificates of the servers it connects to, for talking to what, unless
+// the policy forbids that.
+func insecureTransport(what string) (http.RoundTripper, error) {
+	if orgPolicy.ForbidInsecureSkipVerify {
+		return nil, policyError("forbid_insecure_skip_verify", "can't skip verifying the certificate of %s", what)
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig()
+	t.TLSClientConfig.InsecureSkipVerify = true
+	return t, nil
+}
+
+// policyError says which rule of the policy blocked something.
+func policyError(rule, format string, args ...interface{}) error {
+	return fmt.Errorf("%s, blocked by %s in %s", fmt.Sprintf(format, args...), rule, policyFile)
+}
+
+// checkIssuer checks dexy may log in at issuer.
+func (pol *policy) checkIssuer(issuer string) error {
+	if pol.MinTLSVersion != "" && !strings.HasPrefix(issuer, "https://") {
+		return policyError("min_tls_version", "issuer %s doesn't use TLS", issuer)
+	}
+	if len(pol.AllowedIssuers) == 0 {
+		return nil
+	}
+	for _, allowed := range pol.AllowedIssuers {
+		if strings.TrimSuffix(allowed, "/") == strings.TrimSuffix(issuer, "/") {
+			return nil
+		}
+	}
+	return policyError("allowed_issuers", "issuer %s isn't allowed", issuer)
+}
+
+// checkClientID checks dexy may log in as clientID.
+func (pol *policy) checkClientID(clientID string) error {
+	if len(pol.AllowedClientIDs) > 0 && !contains(pol.AllowedClientIDs, clientID) {
+		return policyError("allowed_client_ids", "client ID %q isn't allowed", clientID)
+	}
+	return nil
+}
+
+// checkProfile checks p against the policy, and turns on what it requires.
+func (pol *policy) checkProfile(p *profile) error {
+	if err := pol.checkIssuer(p.Issuer); err != nil {
+		return err
+	}
+	if err := pol.checkClientID(p.ClientID); err != nil {
+		return err
+	}
+	if pol.ForbidPlaintextSecrets {
+		values := map[string]interface{}{}
+		flattenConfig(p.key, viper.Get(p.key), values)
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if origin := configOrigin(k); origin != "" && secretKeyRe.MatchString(k) {
+				return policyError("forbid_plaintext_secrets", "%s is in %s, set %s instead", k, origin, envName(k))
+			}
+		}
+	}
+	if pol.RequirePKCE {
+		p.PKCE = true
+	}
+	return nil
+}
+
+// checkRegister checks dexy may register a client of its own. The provider
+// picks the new client's ID, and its credentials have to be saved.
+func (pol *policy) checkRegister() error {
+	if len(pol.AllowedClientIDs) > 0 {
+		return policyError("allowed_client_ids", "can't register a client with an ID the policy doesn't know")
+	}
+	if pol.ForbidPlaintextSecrets {
+		return policyError("forbid_plaintext_secrets", "can't save the registration's credentials in a config file")
+	}
+	return nil
+}
+
+// checkSave checks values can be written to a config file.
+func (pol *policy) checkSave(values map[string]interface{}) error {
+	if !pol.ForbidPlaintextSecrets {
+		return nil
+	}
+	for k, v := range values {
+		if v != nil && secretKeyRe.MatchString(k) {
+			return policyError("forbid_plaintext_secrets", "can't save %s in a config file", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckIssuer(t *testing.T) {
+	tests := []struct {
+		name    string
+		pol     policy
+		issuer  string
+		wantErr string
+	}{
+		{"no policy", policy{}, "http://dex.local", ""},
+		{"allowed", policy{AllowedIssuers: []string{"https://dex.example.com/"}}, "https://dex.example.com", ""},
+		{"not allowed", policy{AllowedIssuers: []string{"https://dex.example.com"}}, "https://dex.example.com.evil", "allowed_issuers"},
+		{"plain http with min TLS", policy{MinTLSVersion: "1.2"}, "http://dex.example.com", "min_tls_version"},
+		{"https with min TLS", policy{MinTLSVersion: "1.2"}, "https://dex.example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkPolicyError(t, tt.pol.checkIssuer(tt.issuer), tt.wantErr)
+		})
+	}
+}
+
+func TestCheckClientID(t *testing.T) {
+	pol := policy{AllowedClientIDs: []string{"dexy", "ci"}}
+	checkPolicyError(t, pol.checkClientID("ci"), "")
+	checkPolicyError(t, pol.checkClientID("other"), "allowed_client_ids")
+	checkPolicyError(t, (&policy{}).checkClientID("other"), "")
+}
+
+func TestCheckProfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		pol      policy
+		wantErr  string
+		wantPKCE bool
+	}{
+		{"no policy", `dex_host: https://dex.example.com`, policy{}, "", false},
+		{"PKCE required", `dex_host: https://dex.example.com`, policy{RequirePKCE: true}, "", true},
+		{"issuer not allowed", `dex_host: https://other.example.com`,
+			policy{AllowedIssuers: []string{"https://dex.example.com"}}, "allowed_issuers", false},
+		{"client not allowed", `dex_host: https://dex.example.com`,
+			policy{AllowedClientIDs: []string{"ci"}}, "allowed_client_ids", false},
+		{"secret in config", "dex_host: https://dex.example.com\n    client_secret: s3cret",
+			policy{ForbidPlaintextSecrets: true}, "forbid_plaintext_secrets", false},
+		{"no secret in config", `dex_host: https://dex.example.com`,
+			policy{ForbidPlaintextSecrets: true}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, "profiles:\n  dev:\n    client_id: dexy\n    "+tt.config+"\n")
+			p, err := loadProfile("dev")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.PKCE = false
+			checkPolicyError(t, tt.pol.checkProfile(p), tt.wantErr)
+			if p.PKCE != tt.wantPKCE {
+				t.Errorf("PKCE = %v, want %v", p.PKCE, tt.wantPKCE)
+			}
+		})
+	}
+}
+
+func TestCheckProfileSecretFromEnvironment(t *testing.T) {
+	useConfig(t, "profiles:\n  dev:\n    dex_host: https://dex.example.com\n    client_id: dexy\n")
+	p, err := loadProfile("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.ClientSecret = "s3cret"
+	pol := policy{ForbidPlaintextSecrets: true}
+	checkPolicyError(t, pol.checkProfile(p), "")
+}
+
+func TestCheckSave(t *testing.T) {
+	pol := policy{ForbidPlaintextSecrets: true}
+	tests := []struct {
+		values  map[string]interface{}
+		wantErr string
+	}{
+		{map[string]interface{}{"profiles.dev.client_id": "dexy"}, ""},
+		{map[string]interface{}{"profiles.dev.client_secret": "s3cret"}, "forbid_plaintext_secrets"},
+		{map[string]interface{}{"profiles.dev.registration.access_token": "t"}, "forbid_plaintext_secrets"},
+		// Removing a secret is always allowed.
+		{map[string]interface{}{"profiles.dev.client_secret": nil}, ""},
+	}
+	for _, tt := range tests {
+		checkPolicyError(t, pol.checkSave(tt.values), tt.wantErr)
+	}
+	checkPolicyError(t, (&policy{}).checkSave(map[string]interface{}{"profiles.dev.client_secret": "s3cret"}), "")
+}
+
+func TestCheckRegister(t *testing.T) {
+	checkPolicyError(t, (&policy{}).checkRegister(), "")
+	checkPolicyError(t, (&policy{AllowedClientIDs: []string{"dexy"}}).checkRegister(), "allowed_client_ids")
+	checkPolicyError(t, (&policy{ForbidPlaintextSecrets: true}).checkRegister(), "forbid_plaintext_secrets")
+}
+
+func TestInsecureTransport(t *testing.T) {
+	orgPolicy = policy{ForbidInsecureSkipVerify: true}
+	defer func() { orgPolicy = policy{} }()
+	if _, err := insecureTransport("vault"); err == nil || !strings.Contains(err.Error(), "forbid_insecure_skip_verify") {
+		t.Errorf("insecureTransport = %v, want it blocked", err)
+	}
+
+	orgPolicy = policy{}
+	rt, err := insecureTransport("vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rt.(*http.Transport).TLSClientConfig.InsecureSkipVerify {
+		t.Error("the transport verifies certificates")
+	}
+}
+
+// checkPolicyError checks err is from the rule wantErr, or nil if that is
+// empty.
+func checkPolicyError(t *testing.T, err error, wantErr string) {
+	t.Helper()
+	switch {
+	case wantErr == "" && err != nil:
+		t.Errorf("unexpected error %v", err)
+	case wantErr != "" && (err == nil || !strings.Contains(err.Error(), "blocked by "+wantErr)):
+		t.Errorf("error %v, want one from %s", err, wantErr)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+// policyFile is where administrators put the policy dexy enforces.
+const policyFile = "/etc/dexy/policy.yaml"
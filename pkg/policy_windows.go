@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// policyFile is where administrators put the policy dexy enforces.
+var policyFile = filepath.Join(programData(), "dexy", "policy.yaml")
+
+// programData returns the ProgramData directory. A policy is never read from
+// a relative path, which would depend on the working directory.
+func programData() string {
+	if dir := os.Getenv("ProgramData"); filepath.IsAbs(dir) {
+		return dir
+	}
+	return `C:\ProgramData`
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/viper"
+)
+
+const defaultProfile = "default"
+
+// Ways of logging a user in, set with login: in a profile or --login.
+const (
+	loginBrowser = "browser"
+	loginDevice  = "device"
+	loginPaste   = "paste"
+)
+
+var (
+	profileName string
+	audience    string
+)
+
+// profile is a dexy.Config read from the config file, along with the
+// settings only the command line cares about. Profiles live under
+// "profiles.<name>" in the config file; the top-level "auth" section is
+// still read as the default profile.
+type profile struct {
+	dexy.Config
+	key string
+
+	// LoginMethod picks how users log in for the authorization code grant,
+	// and CallbackHost and CallbackPort are where the browser login listens.
+	LoginMethod  string
+	CallbackHost string
+	CallbackPort int
+
+	// PasswordGrant allows --password-grant to be used with this profile.
+	PasswordGrant bool
+	Username      string
+}
+
+// loadProfile reads the named profile from the config. An empty name falls
+// back to the "profile" config key and then to the default profile.
+func loadProfile(name string) (*profile, error) {
+	name, key, ok := profileKey(name)
+	if !ok {
+		return nil, fmt.Errorf("no profile named %q in config", name)
+	}
+
+	p := &profile{
+		Config: dexy.Config{
+			Name:             name,
+			Grant:            viper.GetString(key + ".grant"),
+			Issuer:           viper.GetString(key + ".dex_host"),
+			ClientID:         viper.GetString(key + ".client_id"),
+			ClientSecret:     viper.GetString(key + ".client_secret"),
+			Scopes:           viper.GetStringSlice(key + ".scopes"),
+			Audiences:        viper.GetStringSlice(key + ".audiences"),
+			Audience:         audience,
+			AssertionKeyFile: viper.GetString(key + ".client_assertion.key_file"),
+			AssertionKeyID:   viper.GetString(key + ".client_assertion.key_id"),
+			AssertionAlg:     viper.GetString(key + ".client_assertion.alg"),
+			AuthParams:       authParams(key),
+			PKCE:             viper.GetBool(key + ".pkce"),
+			Require:          loadRequirements(key),
+		},
+		key:           key,
+		LoginMethod:   viper.GetString(key + ".login"),
+		CallbackHost:  viper.GetString(key + ".callback_host"),
+		CallbackPort:  viper.GetInt(key + ".callback_port"),
+		PasswordGrant: viper.GetBool(key + ".password_grant"),
+		Username:      viper.GetString(key + ".username"),
+	}
+
+	flagParams, err := flagAuthParams()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range flagParams {
+		p.AuthParams[k] = v
+	}
+	p.ForceLogin = len(flagParams) > 0
+
+	if p.Grant == "" {
+		p.Grant = dexy.GrantAuthCode
+	}
+	if p.LoginMethod == "" {
+		p.LoginMethod = loginBrowser
+	}
+
+	switch p.Grant {
+	case dexy.GrantAuthCode, dexy.GrantClientCredentials:
+	default:
+		return nil, fmt.Errorf("profile %q has unsupported grant %q", name, p.Grant)
+	}
+	switch p.LoginMethod {
+	case loginBrowser, loginDevice, loginPaste:
+	default:
+		return nil, fmt.Errorf("profile %q has unknown login %q, must be browser, device or paste", name, p.LoginMethod)
+	}
+	if p.Issuer == "" {
+		return nil, fmt.Errorf("profile %q has no dex_host set", name)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("profile %q: %v", name, err)
+	}
+	if err := orgPolicy.checkProfile(p); err != nil {
+		return nil, fmt.Errorf("profile %q: %v", name, err)
+	}
+	return p, nil
+}
+
+// authParams reads the auth_params of the profile under key, along with any
+// set or overridden with DEXY_<KEY>_AUTH_PARAMS_<PARAM> environment
+// variables.
+func authParams(key string) map[string]string {
+	params := map[string]string{}
+	for k := range viper.GetStringMap(key + ".auth_params") {
+		params[k] = viper.GetString(key + ".auth_params." + k)
+	}
+	prefix := envName(key+".auth_params") + "_"
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		if i > len(prefix) && strings.HasPrefix(kv, prefix) && kv[i+1:] != "" {
+			params[strings.ToLower(kv[len(prefix):i])] = kv[i+1:]
+		}
+	}
+	return params
+}
+
+// profileKey resolves name the way loadProfile does, and returns the config
+// key its settings live under and whether there can be such a profile. The
+// default profile always can, falling back to the auth section.
+func profileKey(name string) (string, string, bool) {
+	if name == "" {
+		name = viper.GetString("profile")
+	}
+	if name == "" {
+		name = defaultProfile
+	}
+	key := "profiles." + name
+	// A profile can also be given entirely with flags or DEXY_PROFILES_
+	// environment variables, which IsSet can't see from the section's key.
+	if viper.IsSet(key) || viper.GetString(key+".dex_host") != "" {
+		return name, key, true
+	}
+	return name, "auth", name == defaultProfile
+}
+
+// client returns a dexy.Client for the profile as it is now, using dexy's
+// cache and rendering the profile's sinks for every new token.
+func (p *profile) client() (*dexy.Client, error) {
+	cfg := p.Config
+	cfg.Cache = tokenCache()
+	cfg.Login = p.login()
+	cfg.OnNewToken = p.renderSinks
+	return dexy.NewClient(cfg)
+}
+
+// login returns how to log the user in.
+func (p *profile) login() dexy.Login {
+	if passwordGrant {
+		return dexy.PasswordLogin{Credentials: func() (string, string, error) {
+			return passwordCredentials(p)
+		}}
+	}
+	switch p.LoginMethod {
+	case loginDevice:
+		return dexy.DeviceLogin{}
+	case loginPaste:
+		return dexy.PasteLogin{}
+	}
+	return dexy.BrowserLogin{Host: p.CallbackHost, Port: p.CallbackPort}
+}
+
+// tokenCache is the token cache all of dexy's commands share.
+func tokenCache() *dexy.Store {
+	s := dexy.NewStore(viper.GetString("token_file"))
+	s.MaxAge = orgPolicy.MaxCacheLifetime
+	return s
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/pressly/chi"
+	"github.com/spf13/cobra"
+)
+
+var proxyOpts struct {
+	listen        string
+	upstream      string
+	refreshBefore time.Duration
+	insecure      bool
+}
+
+// proxyCmd is a local reverse proxy that adds the profile's token to every
+// request, for clients that can't set an Authorization header themselves.
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Run a local reverse proxy that adds a token to every request",
+	Long: `Run a local reverse proxy that adds a token to every request.
+
+Every request to the listen address is sent on to the upstream with an
+Authorization: Bearer header holding the profile's token. The token is
+refreshed before it expires, and a request the upstream rejects with 401 is
+retried once with a new token. Anyone who can reach the listen address can
+use your token, so keep it on localhost.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if proxyOpts.upstream == "" {
+			log.Fatalf("--upstream is required")
+		}
+		upstream, err := url.Parse(proxyOpts.upstream)
+		if err != nil {
+			log.Fatalf("error while parsing upstream url %v", err)
+		}
+		p, err := loadProfile(profileName)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+
+		src := &proxyTokenSource{p: p, refreshBefore: proxyOpts.refreshBefore}
+		// Log in before accepting connections, rather than in the middle of
+		// the first request.
+		if _, err := src.Token(context.Background()); err != nil {
+			log.Fatalf("error while getting token %v", err)
+		}
+
+		proxy := newProxy(upstream, src)
+		if proxyOpts.insecure {
+			t, err := insecureTransport(upstream.Host)
+			if err != nil {
+				log.Fatalf("error while setting up the upstream connection %v", err)
+			}
+			proxy.Transport = &dexy.Transport{Source: src, Base: t}
+		}
+
+		r := chi.NewRouter()
+		r.Handle("/*", proxy)
+		log.Printf("proxying %s to %s", proxyOpts.listen, upstream)
+		log.Fatal(http.ListenAndServe(proxyOpts.listen, r))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(proxyCmd)
+	flags := proxyCmd.Flags()
+	flags.StringVar(&proxyOpts.listen, "listen", "127.0.0.1:8080", "address to listen on")
+	flags.StringVar(&proxyOpts.upstream, "upstream", "", "URL to send requests on to")
+	flags.DurationVar(&proxyOpts.refreshBefore, "refresh-before", 2*time.Minute, "how long before expiry to refresh the token")
+	flags.BoolVar(&proxyOpts.insecure, "insecure-skip-verify", false, "don't verify the upstream's TLS certificate, for testing only")
+}
+
+// proxyTokenSource holds the proxy's current token. It gets tokens from the
+// agent when one is running, like every other command.
+type proxyTokenSource struct {
+	p             *profile
+	refreshBefore time.Duration
+
+	mu  sync.Mutex
+	tok *dexy.Token
+}
+
+// Token returns the current token, refreshing it if it is close to expiry.
+func (s *proxyTokenSource) Token(ctx context.Context) (*dexy.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok.ValidFor(s.refreshBefore) {
+		return s.tok, nil
+	}
+	p := *s.p
+	p.MinValidity = s.refreshBefore
+	tok, err := tokenFor(ctx, &p)
+	if err != nil {
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+// Refresh replaces rejected with a new token. If another request has
+// already replaced it, that token is used instead.
+func (s *proxyTokenSource) Refresh(ctx context.Context, rejected *dexy.Token) (*dexy.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tok != nil && s.tok.AccessToken != rejected.AccessToken {
+		return s.tok, nil
+	}
+	p := *s.p
+	p.MinValidity = s.refreshBefore
+	tok, err := refreshFor(ctx, &p, rejected)
+	if err != nil {
+		log.Printf("error while refreshing token after 401 %v", err)
+		return nil, err
+	}
+	s.tok = tok
+	return tok, nil
+}
+
+func newProxy(upstream *url.URL, src *proxyTokenSource) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = upstream.Host
+	}
+	proxy.Transport = &dexy.Transport{Source: src}
+	// Pass streamed responses on as they arrive.
+	proxy.FlushInterval = 100 * time.Millisecond
+	return proxy
+}
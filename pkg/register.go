@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var registerOpts struct {
+	issuer             string
+	clientName         string
+	initialAccessToken string
+	force              bool
+}
+
+// registerCmd registers dexy as a client of providers that support dynamic
+// client registration, instead of asking their admins for a static client.
+var registerCmd = &cobra.Command{
+	Use:   "register",
+	Short: "Register a client with the provider and save it in the profile",
+	Long: `Register a client with the provider using dynamic client registration
+(RFC 7591), and save its client_id and secret in the profile.
+
+The client is registered as a native app with the profile's loopback
+redirect URI. With --issuer a profile that doesn't exist yet is created. The
+registration access token is saved too, for the show, update and delete
+subcommands. Saving rewrites the config file, which loses any comments in it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := orgPolicy.checkRegister(); err != nil {
+			log.Fatalf("error while registering client %v", err)
+		}
+		p, err := registrationProfile()
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		if p.ClientID != "" && !registerOpts.force {
+			log.Fatalf("profile %q already has client_id %s, use register update or register delete, or --force to register a new client anyway", p.Name, p.ClientID)
+		}
+		reg, err := dexy.Register(context.Background(), p.Issuer, initialAccessToken(), registrationMetadata(p))
+		if err != nil {
+			log.Fatalf("error while registering client %v", err)
+		}
+		path, err := saveRegistration(p, reg)
+		if err != nil {
+			log.Fatalf("error while saving registration %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Registered client %s, saved in profile %s of %s\n", reg.ClientID, p.Name, path)
+	},
+}
+
+var registerShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the provider's view of the profile's registered client",
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := registrationProfile()
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		reg, err := dexy.ReadRegistration(context.Background(), savedRegistration(p))
+		if err != nil {
+			log.Fatalf("error while reading registration %v", err)
+		}
+		// Don't print the credentials, they are in the config already.
+		reg.ClientSecret, reg.RegistrationAccessToken = "", ""
+		b, err := json.MarshalIndent(reg, "", "  ")
+		if err != nil {
+			log.Fatalf("error while encoding registration %v", err)
+		}
+		fmt.Println(string(b))
+	},
+}
+
+var registerUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Update the profile's registered client to match the profile",
+	Long: `Update the profile's registered client to match the profile, for
+example after changing its callback_port or login.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := registrationProfile()
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		saved := savedRegistration(p)
+		reg, err := dexy.UpdateRegistration(context.Background(), saved, registrationMetadata(p))
+		if err != nil {
+			log.Fatalf("error while updating registration %v", err)
+		}
+		// The provider only sends the credentials back if it changed them.
+		if reg.ClientSecret == "" {
+			reg.ClientSecret = saved.ClientSecret
+		}
+		if reg.RegistrationAccessToken == "" {
+			reg.RegistrationAccessToken = saved.RegistrationAccessToken
+		}
+		if reg.RegistrationClientURI == "" {
+			reg.RegistrationClientURI = saved.RegistrationClientURI
+		}
+		path, err := saveRegistration(p, reg)
+		if err != nil {
+			log.Fatalf("error while saving registration %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Updated client %s, saved in profile %s of %s\n", reg.ClientID, p.Name, path)
+	},
+}
+
+var registerDeleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete the profile's registered client and remove it from the profile",
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := registrationProfile()
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		if err := dexy.DeleteRegistration(context.Background(), savedRegistration(p)); err != nil {
+			log.Fatalf("error while deleting registration %v", err)
+		}
+		if err := forgetToken(p); err != nil {
+			log.Printf("warning: error while removing cached tokens %v", err)
+		}
+		path, err := updateConfig(map[string]interface{}{
+			p.key + ".client_id":     nil,
+			p.key + ".client_secret": nil,
+			p.key + ".registration":  nil,
+		})
+		if err != nil {
+			log.Fatalf("error while saving profile %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Deleted client %s, removed from profile %s of %s\n", p.ClientID, p.Name, path)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(registerCmd)
+	registerCmd.AddCommand(registerShowCmd, registerUpdateCmd, registerDeleteCmd)
+	flags := registerCmd.Flags()
+	flags.StringVar(&registerOpts.issuer, "issuer", "", "issuer to register with (default is the profile's dex_host)")
+	flags.StringVar(&registerOpts.initialAccessToken, "initial-access-token", "", "token the provider requires to register clients (default is $DEXY_INITIAL_ACCESS_TOKEN)")
+	flags.BoolVar(&registerOpts.force, "force", false, "register a new client even if the profile already has one")
+	registerCmd.PersistentFlags().StringVar(&registerOpts.clientName, "client-name", "dexy", "name of the client shown to users")
+}
+
+// registrationProfile loads the profile to register, which with --issuer
+// needn't exist yet.
+func registrationProfile() (*profile, error) {
+	name, key, ok := profileKey(profileName)
+	if !ok {
+		key = "profiles." + name
+	}
+	if registerOpts.issuer != "" {
+		viper.Set(key+".dex_host", registerOpts.issuer)
+	}
+	return loadProfile(name)
+}
+
+func initialAccessToken() string {
+	if registerOpts.initialAccessToken != "" {
+		return registerOpts.initialAccessToken
+	}
+	return os.Getenv("DEXY_INITIAL_ACCESS_TOKEN")
+}
+
+// registrationMetadata describes the client p needs: a native app using
+// the profile's way of logging in.
+func registrationMetadata(p *profile) dexy.ClientMetadata {
+	host, port := p.CallbackHost, p.CallbackPort
+	if host == "" {
+		host = "localhost"
+	}
+	if port == 0 {
+		port = 10111
+	}
+	m := dexy.ClientMetadata{
+		ClientName:      registerOpts.clientName,
+		RedirectURIs:    []string{fmt.Sprintf("http://%s:%d/oauth2/callback", host, port)},
+		GrantTypes:      []string{dexy.GrantAuthCode, "refresh_token"},
+		ResponseTypes:   []string{"code"},
+		ApplicationType: "native",
+		Scope:           strings.Join(append([]string{"openid"}, p.Scopes...), " "),
+	}
+	switch p.LoginMethod {
+	case loginPaste:
+		m.RedirectURIs = append(m.RedirectURIs, dexy.OOBRedirectURL)
+	case loginDevice:
+		m.GrantTypes = append(m.GrantTypes, dexy.GrantDeviceCode)
+	}
+	return m
+}
+
+// savedRegistration is the registration saved in p by register.
+func savedRegistration(p *profile) *dexy.Registration {
+	return &dexy.Registration{
+		ClientID:                p.ClientID,
+		ClientSecret:            p.ClientSecret,
+		RegistrationClientURI:   viper.GetString(p.key + ".registration.client_uri"),
+		RegistrationAccessToken: viper.GetString(p.key + ".registration.access_token"),
+	}
+}
+
+// saveRegistration writes reg into p's section of the config file.
+func saveRegistration(p *profile, reg *dexy.Registration) (string, error) {
+	values := map[string]interface{}{
+		p.key + ".dex_host":      p.Issuer,
+		p.key + ".client_id":     reg.ClientID,
+		p.key + ".client_secret": nil,
+		p.key + ".registration":  nil,
+	}
+	if reg.ClientSecret != "" {
+		values[p.key+".client_secret"] = reg.ClientSecret
+	}
+	if reg.RegistrationAccessToken != "" {
+		values[p.key+".registration.client_uri"] = reg.RegistrationClientURI
+		values[p.key+".registration.access_token"] = reg.RegistrationAccessToken
+		delete(values, p.key+".registration")
+	}
+	if reg.ClientID != p.ClientID {
+		if err := forgetToken(p); err != nil {
+			log.Printf("warning: error while removing cached tokens %v", err)
+		}
+	}
+	return updateConfig(values)
+}
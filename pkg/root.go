@@ -21,23 +21,18 @@
 package cmd
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"os"
-	"time"
+	"path/filepath"
+	"strings"
 
-	"encoding/json"
 	"io/ioutil"
-	"net/http"
 
-	"github.com/coreos/go-oidc"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/browser"
-	"github.com/pressly/chi"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"golang.org/x/oauth2"
 )
 
 var cfgFile string
@@ -50,122 +45,20 @@ var RootCmd = &cobra.Command{
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
-		b, err := ioutil.ReadFile(viper.GetString("token_file"))
-		if err == nil {
-			// Check if expiry is what we expect.
-			var tok returnToken
-			err = json.Unmarshal(b, &tok)
-			if err != nil {
-				log.Fatalf("error while unmarshalling token from file %v", err)
-			}
-
-			if tok.ExpiryTime.After(time.Now()) {
-				// We've not expired, so just return the token from the file.
-				fmt.Println(string(b))
-				return
-			}
-		}
-
-		// Our token has either expired or doesn't exist.
-		provider, err := oidc.NewProvider(context.Background(), viper.GetString("auth.dex_host"))
-		if err != nil {
-			log.Fatalf("error while creating new oidc provider %v", err)
-		}
-		scopes := []string{oidc.ScopeOpenID}
-		scopes = append(scopes, viper.GetStringSlice("auth.scopes")...)
-		oauth2Config := oauth2.Config{
-			ClientID:     viper.GetString("auth.client_id"),
-			ClientSecret: viper.GetString("auth.client_secret"),
-			RedirectURL:  viper.GetString("auth.callback_url"),
-			Endpoint:     provider.Endpoint(),
-			Scopes:       scopes,
-		}
-
-		tokenChan := make(chan *returnToken)
-		w := &web{
-			verifier:  provider.Verifier(&oidc.Config{ClientID: viper.GetString("auth.client_id")}),
-			cfg:       oauth2Config,
-			tokenChan: tokenChan,
-		}
-		go w.Serve()
-
-		err = browser.OpenURL(oauth2Config.AuthCodeURL(""))
-		if err != nil {
-			log.Fatalf("error while opening new web browser %v", err)
-		}
-		tok := <-tokenChan
-
-		b, err = json.Marshal(tok)
-		if err != nil {
-			log.Fatalf("error while marshalling token from provider %v", err)
-		}
-
-		err = ioutil.WriteFile(viper.GetString("token_file"), b, 0755)
-		if err != nil {
-			log.Fatalf("error while attempting to write token to file %v", err)
-		}
-
-		fmt.Println(string(b))
+		runToken()
 	},
 }
 
-type returnToken struct {
-	AccessToken string    `json:"access_token"`
-	ExpiryTime  time.Time `json:"expiry_time"`
-}
-
-type web struct {
-	verifier  *oidc.IDTokenVerifier
-	cfg       oauth2.Config
-	tokenChan chan *returnToken
-}
-
-func (s *web) Serve() {
-	r := chi.NewRouter()
-
-	oauth := chi.NewRouter()
-	oauth.Get("/callback", s.oauth2Callback)
-	r.Mount("/oauth2", oauth)
-	http.ListenAndServe(":10111", r)
-}
-
-func (s *web) oauth2Callback(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
-	oauth2Token, err := s.cfg.Exchange(ctx, r.URL.Query().Get("code"))
-	if err != nil {
-		log.Fatalf("error while attempting initial token exchange %v", err)
-	}
-
-	// Extract the ID Token from OAuth2 token.
-	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
-	if !ok {
-		// handle missing token
-		log.Fatalf("missing id_token")
-	}
-
-	// Parse and verify ID Token payload.
-	idToken, err := s.verifier.Verify(ctx, rawIDToken)
-	if err != nil {
-		fmt.Println(err.Error())
-		// handle error
-	}
-
-	ret := &returnToken{
-		AccessToken: rawIDToken,
-		ExpiryTime:  idToken.Expiry,
-	}
-	s.tokenChan <- ret
-
-	fmt.Fprintf(w, "Done, you can now close this window")
-}
-
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	browser.Stdout = ioutil.Discard
 	browser.Stderr = ioutil.Discard
 
+	if invokedAs() == dockerCredentialHelperName {
+		RootCmd.SetArgs(append([]string{dockerCredentialCmd.Name()}, os.Args[1:]...))
+	}
+
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -178,7 +71,10 @@ func init() {
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
-	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.dexy.yaml)")
+	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file to use instead of merging /etc/dexy/.dexy.yaml, $HOME/.dexy.yaml and project files")
+	RootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "profile to use (default is the auth section of the config)")
+	addSettingFlags(RootCmd.PersistentFlags())
+	addTokenFlags(RootCmd.Flags())
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -189,25 +85,43 @@ func initConfig() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	// Merge the system, user and project config files, or use only the
+	// one from the flag. Project files can only pick the profile, unless
+	// the system or user config trusts them.
+	base, project := configFiles(home)
 	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
+		base, project = nil, nil
+		if _, err := os.Stat(cfgFile); err == nil {
+			base = []string{cfgFile}
+		}
+	}
+	for _, f := range base {
+		if err := mergeConfigFile(f, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "dexy: ignoring config file %s: %v\n", f, err)
+		}
+	}
+	for _, f := range project {
+		allowed := projectKeys
+		if trustedProject(f) {
+			allowed = nil
+		}
+		if err := mergeConfigFile(f, allowed); err != nil {
+			fmt.Fprintf(os.Stderr, "dexy: ignoring config file %s: %v\n", f, err)
+			continue
+		}
+		if l := configLayers[len(configLayers)-1]; len(l.ignored) > 0 {
+			fmt.Fprintf(os.Stderr, "dexy: ignoring %s in %s, add %s to trusted_projects in $HOME/.dexy.yaml to use them\n",
+				strings.Join(l.ignored, ", "), f, filepath.Dir(f))
+		}
+	}
 
-		// Search config in home directory with name ".dexy" (without extension).
-		viper.AddConfigPath(home)
-		viper.AddConfigPath("/etc/dexy")
-		viper.AddConfigPath(".")
-		viper.SetConfigName(".dexy")
+	if err := loadPolicy(); err != nil {
+		log.Fatalf("error while reading policy %v", err)
 	}
+
 	viper.SetEnvPrefix("dexy")
+	viper.SetEnvKeyReplacer(envKeyReplacer)
 	viper.AutomaticEnv() // read in environment variables that match
 	viper.SetDefault("token_file", home+"/.dexy-token.yaml")
-
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-	}
-	viper.Set("auth.callback_url", fmt.Sprintf("http://%s:%d/oauth2/callback",
-		viper.GetString("auth.callback_host"),
-		viper.GetInt("auth.callback_port")))
+	bindSettingFlags(RootCmd.PersistentFlags())
 }
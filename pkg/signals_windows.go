@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+)
+
+// forwardedSignals are passed on to commands run by dexy exec.
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+// namedSignals are the signals dexy watch can send, by name.
+var namedSignals = map[string]os.Signal{
+	"INT":  os.Interrupt,
+	"KILL": os.Kill,
+}
+
+// shellCommand runs command with cmd.exe.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// sinksCmd renders the profile's sinks from its current token. dexy does
+// this itself whenever it gets a new token; this is for the first time, or
+// after changing the sinks in the config.
+var sinksCmd = &cobra.Command{
+	Use:   "sinks",
+	Short: "Write the profile's token into the files its sinks point at",
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := loadProfile(profileName)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		tok, err := tokenFor(context.Background(), p)
+		if err != nil {
+			log.Fatalf("error while getting token %v", err)
+		}
+		sinks, err := p.sinks()
+		if err != nil {
+			log.Fatalf("error while reading sinks %v", err)
+		}
+		for _, s := range sinks {
+			if err := s.render(p, tok); err != nil {
+				log.Fatalf("error while writing %s %v", s.Path, err)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(sinksCmd)
+}
+
+// sink renders a token into a file another tool reads credentials from.
+// Type picks a built-in template (netrc, npmrc, pip or pgpass), or Template
+// gives one. Only the block between dexy's markers is ever rewritten, so the
+// rest of the file is left alone, except that types with a section comment
+// out the keys dexy sets that are already in it.
+type sink struct {
+	Type     string `mapstructure:"type"`
+	Path     string `mapstructure:"path"`
+	Template string `mapstructure:"template"`
+	// Name tells apart the blocks of several sinks of one profile that
+	// write to the same file.
+	Name     string `mapstructure:"name"`
+	Token    string `mapstructure:"token"`
+	Audience string `mapstructure:"audience"`
+
+	Host     string `mapstructure:"host"`
+	Port     string `mapstructure:"port"`
+	Database string `mapstructure:"database"`
+	Username string `mapstructure:"username"`
+	Registry string `mapstructure:"registry"`
+	IndexURL string `mapstructure:"index_url"`
+}
+
+var sinkTemplates = map[string]string{
+	"netrc":  "machine {{.Host}} login {{.Username}} password {{.Token}}",
+	"npmrc":  "{{.Registry}}:_authToken={{.Token}}",
+	"pip":    "index-url = {{withCredentials .IndexURL .Username .Token}}",
+	"pgpass": "{{.Host}}:{{.Port}}:{{.Database}}:{{.Username}}:{{pgpassEscape .Token}}",
+}
+
+// sinkSections are the INI sections the blocks of some types must go in.
+var sinkSections = map[string]string{
+	"pip": "global",
+}
+
+var sinkFuncs = template.FuncMap{
+	"withCredentials": func(rawurl, username, password string) (string, error) {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return "", err
+		}
+		u.User = url.UserPassword(username, password)
+		return u.String(), nil
+	},
+	"pgpassEscape": strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace,
+}
+
+// sinks returns the profile's sinks, with the defaults for their type
+// filled in.
+func (p *profile) sinks() ([]sink, error) {
+	var sinks []sink
+	if err := viper.UnmarshalKey(p.key+".sinks", &sinks); err != nil {
+		return nil, err
+	}
+	for i := range sinks {
+		s := &sinks[i]
+		if s.Path == "" {
+			return nil, fmt.Errorf("sink %d has no path", i)
+		}
+		if s.Template == "" {
+			s.Template = sinkTemplates[s.Type]
+		}
+		if s.Template == "" {
+			return nil, fmt.Errorf("sink %s has no template and unknown type %q", s.Path, s.Type)
+		}
+		switch s.Type {
+		case "pgpass":
+			for _, f := range []*string{&s.Port, &s.Database, &s.Username} {
+				if *f == "" {
+					*f = "*"
+				}
+			}
+		case "netrc", "pip":
+			if s.Username == "" {
+				s.Username = "dexy"
+			}
+		}
+	}
+	return sinks, nil
+}
+
+// renderSinks rewrites every sink of p for its new token. A sink that can't
+// be written shouldn't stop the token being used, so errors are only logged.
+func (p *profile) renderSinks(tok *dexy.Token) {
+	sinks, err := p.sinks()
+	if err != nil {
+		log.Printf("warning: error while reading sinks of profile %s %v", p.Name, err)
+		return
+	}
+	for _, s := range sinks {
+		if s.Audience != p.Audience {
+			continue
+		}
+		if err := s.render(p, tok); err != nil {
+			log.Printf("warning: error while writing %s %v", s.Path, err)
+		}
+	}
+}
+
+func (s sink) render(p *profile, tok *dexy.Token) error {
+	t, err := template.New(s.Path).Funcs(sinkFuncs).Parse(s.Template)
+	if err != nil {
+		return err
+	}
+	var c dexy.Claims
+	dexy.UnverifiedClaims(tok.AccessToken, &c)
+	token := tok.AccessToken
+	if s.Token == "access_token" {
+		token = tok.RawAccessToken()
+	}
+	data := struct {
+		sink
+		Profile string
+		Token   string
+		Expiry  time.Time
+		Email   string
+	}{s, p.Name, token, tok.ExpiryTime, c.Email}
+
+	var block bytes.Buffer
+	if err := t.Execute(&block, data); err != nil {
+		return err
+	}
+
+	name := s.Name
+	if name == "" {
+		name = p.Name
+	}
+	path, err := homedir.Expand(s.Path)
+	if err != nil {
+		return err
+	}
+	return writeManagedBlock(path, name, sinkSections[s.Type], block.String())
+}
+
+// writeManagedBlock replaces the block marked for name in the file at path
+// with content, or appends one if there isn't one yet. If section is set the
+// new block goes at the top of that INI section, which is added if needed,
+// and the section's keys that content sets are commented out, since most
+// INI readers refuse a key given twice. The file is replaced atomically and
+// left readable only by its owner.
+func writeManagedBlock(path, name, section, content string) error {
+	// Write through symlinks, like a dotfiles checkout, rather than over them.
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	begin := "# BEGIN dexy " + name
+	end := "# END dexy " + name
+	block := begin + "\n" + strings.TrimRight(content, "\n") + "\n" + end + "\n"
+
+	var out string
+	lines := strings.SplitAfter(string(old), "\n")
+	if section != "" {
+		commentOutKeys(lines, section, content)
+	}
+	start, stop := -1, -1
+	current, blockSection := "", ""
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == begin:
+			start, blockSection = i, current
+		case trimmed == end:
+			if start >= 0 {
+				stop = i
+			}
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			current = trimmed[1 : len(trimmed)-1]
+		}
+		if stop >= 0 {
+			break
+		}
+	}
+	// Older versions of dexy could leave the block in another section.
+	if section != "" && start >= 0 && stop >= 0 && blockSection != section {
+		lines = append(lines[:start:start], lines[stop+1:]...)
+		start, stop = -1, -1
+	}
+	header := -1
+	for i, line := range lines {
+		if section != "" && strings.TrimSpace(line) == "["+section+"]" {
+			header = i
+			break
+		}
+	}
+	switch {
+	case start >= 0 && stop >= 0:
+		out = strings.Join(lines[:start], "") + block + strings.Join(lines[stop+1:], "")
+	case header >= 0:
+		out = strings.Join(lines[:header+1], "")
+		if !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += block + strings.Join(lines[header+1:], "")
+	default:
+		out = strings.Join(lines, "")
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		if section != "" {
+			out += "[" + section + "]\n"
+		}
+		out += block
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(out), 0600)
+}
+
+// commentOutKeys comments out the lines of an INI section that set a key
+// content sets too. Lines in dexy's blocks are left alone.
+func commentOutKeys(lines []string, section, content string) {
+	keys := map[string]bool{}
+	for _, line := range strings.Split(content, "\n") {
+		if k := iniKey(line); k != "" {
+			keys[k] = true
+		}
+	}
+	inSection, inBlock := false, false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "# BEGIN dexy "):
+			inBlock = true
+		case strings.HasPrefix(trimmed, "# END dexy "):
+			inBlock = false
+		case strings.HasPrefix(trimmed, "["):
+			inSection = trimmed == "["+section+"]"
+		case inSection && !inBlock && keys[iniKey(line)]:
+			lines[i] = "# disabled by dexy: " + line
+		}
+	}
+}
+
+// iniKey returns the key an INI line sets, or "" if it doesn't set one.
+// Like pip, it treats - and _ in keys the same.
+func iniKey(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.ContainsAny(line[:1], "#;[") {
+		return ""
+	}
+	i := strings.IndexAny(line, "=:")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Replace(strings.TrimSpace(line[:i]), "_", "-", -1))
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteManagedBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     string
+		section string
+		content string
+		want    string
+	}{
+		{
+			name:    "new file",
+			content: "machine a login dexy password t",
+			want:    "# BEGIN dexy dev\nmachine a login dexy password t\n# END dexy dev\n",
+		},
+		{
+			name:    "appended",
+			old:     "machine b login me password p",
+			content: "machine a login dexy password t",
+			want:    "machine b login me password p\n# BEGIN dexy dev\nmachine a login dexy password t\n# END dexy dev\n",
+		},
+		{
+			name:    "replaced in place",
+			old:     "before\n# BEGIN dexy dev\nold\n# END dexy dev\nafter\n",
+			content: "new\n",
+			want:    "before\n# BEGIN dexy dev\nnew\n# END dexy dev\nafter\n",
+		},
+		{
+			name:    "other blocks left alone",
+			old:     "# BEGIN dexy other\nkept\n# END dexy other\n",
+			content: "new",
+			want:    "# BEGIN dexy other\nkept\n# END dexy other\n# BEGIN dexy dev\nnew\n# END dexy dev\n",
+		},
+		{
+			name:    "section added",
+			old:     "[install]\nno-cache-dir = true\n",
+			section: "global",
+			content: "index-url = https://x",
+			want:    "[install]\nno-cache-dir = true\n[global]\n# BEGIN dexy dev\nindex-url = https://x\n# END dexy dev\n",
+		},
+		{
+			name:    "top of existing section",
+			old:     "[global]\ntimeout = 60\n[install]\nindex-url = https://other\n",
+			section: "global",
+			content: "index-url = https://x",
+			want:    "[global]\n# BEGIN dexy dev\nindex-url = https://x\n# END dexy dev\ntimeout = 60\n[install]\nindex-url = https://other\n",
+		},
+		{
+			name:    "section's duplicate keys commented out",
+			old:     "[global]\nindex_url = https://old\ntimeout = 60\n",
+			section: "global",
+			content: "index-url = https://x",
+			want:    "[global]\n# BEGIN dexy dev\nindex-url = https://x\n# END dexy dev\n# disabled by dexy: index_url = https://old\ntimeout = 60\n",
+		},
+		{
+			name:    "block moved out of the wrong section",
+			old:     "# BEGIN dexy dev\nindex-url = https://old\n# END dexy dev\n[global]\ntimeout = 60\n",
+			section: "global",
+			content: "index-url = https://x",
+			want:    "[global]\n# BEGIN dexy dev\nindex-url = https://x\n# END dexy dev\ntimeout = 60\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			if tt.old != "" {
+				if err := ioutil.WriteFile(path, []byte(tt.old), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writeManagedBlock(path, "dev", tt.section, tt.content); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", b, tt.want)
+			}
+			if fi, err := os.Stat(path); err == nil && fi.Mode().Perm() != 0600 {
+				t.Errorf("file mode %v, want 0600", fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestWriteManagedBlockThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	if err := ioutil.WriteFile(target, []byte("kept\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip(err)
+	}
+	if err := writeManagedBlock(link, "dev", "", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("the symlink was replaced")
+	}
+	if b, _ := ioutil.ReadFile(target); !strings.Contains(string(b), "new") {
+		t.Errorf("target is %q, want the block written through the link", b)
+	}
+}
+
+func TestCommentOutKeys(t *testing.T) {
+	lines := strings.SplitAfter("index-url = a\n[global]\nindex-url = b\nINDEX_URL: c\n; index-url = d\n"+
+		"# BEGIN dexy dev\nindex-url = e\n# END dexy dev\n[install]\nindex-url = f\n", "\n")
+	commentOutKeys(lines, "global", "index-url = new\n")
+	want := "index-url = a\n[global]\n# disabled by dexy: index-url = b\n# disabled by dexy: INDEX_URL: c\n; index-url = d\n" +
+		"# BEGIN dexy dev\nindex-url = e\n# END dexy dev\n[install]\nindex-url = f\n"
+	if got := strings.Join(lines, ""); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestINIKey(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"index-url = x", "index-url"},
+		{"  Index_URL=x", "index-url"},
+		{"timeout: 60", "timeout"},
+		{"# index-url = x", ""},
+		{"; index-url = x", ""},
+		{"[global]", ""},
+		{"", ""},
+		{"no separator", ""},
+	}
+	for _, tt := range tests {
+		if got := iniKey(tt.line); got != tt.want {
+			t.Errorf("iniKey(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
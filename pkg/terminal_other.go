@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package cmd
+
+import (
+	"errors"
+	"os"
+)
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func readPassword(f *os.File) (string, error) {
+	return "", errors.New("reading a password from the terminal is not supported on this platform")
+}
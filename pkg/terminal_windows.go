@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+const enableEchoInput = 0x0004
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// isTerminal reports whether fd refers to a console.
+func isTerminal(fd int) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(fd), &mode) == nil
+}
+
+// readPassword reads a line from the console f with echo turned off.
+func readPassword(f *os.File) (string, error) {
+	h := syscall.Handle(f.Fd())
+	var old uint32
+	if err := syscall.GetConsoleMode(h, &old); err != nil {
+		return "", err
+	}
+	if err := setConsoleMode(h, old&^enableEchoInput); err != nil {
+		return "", err
+	}
+	defer setConsoleMode(h, old)
+	return readLine(f)
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// tokenCmd prints a token for a profile, logging in first if the cached one
+// has expired.
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Print a token for the selected profile",
+	Run: func(cmd *cobra.Command, args []string) {
+		runToken()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(tokenCmd)
+	addTokenFlags(tokenCmd.Flags())
+}
+
+// addTokenFlags adds the flags shared by the root command and tokenCmd.
+func addTokenFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&outputFormat, "output", "o", outputJSON,
+		fmt.Sprintf("output format, one of %v", outputFormats))
+	flags.StringVar(&audience, "audience", "",
+		"get a token issued for another client ID instead of dexy's own")
+	flags.BoolVar(&passwordGrant, "password-grant", false,
+		"log in with a username and password instead of a browser, the profile must set password_grant: true")
+	addAuthParamFlags(flags)
+}
+
+func runToken() {
+	p, err := loadProfile(profileName)
+	if err != nil {
+		log.Fatalf("error while loading profile %v", err)
+	}
+	tok, err := tokenFor(context.Background(), p)
+	if err != nil {
+		log.Fatalf("error while getting token %v", err)
+	}
+	if err := writeToken(os.Stdout, outputFormat, tok); err != nil {
+		log.Fatalf("error while writing token %v", err)
+	}
+}
+
+// tokenFor gets a token for p from the agent if one is running, and
+// otherwise fetches it directly. Logins the agent can't do for us, like
+// prompting for a password, always happen here.
+func tokenFor(ctx context.Context, p *profile) (*dexy.Token, error) {
+	return viaAgent(p, "", func() (*dexy.Token, error) {
+		return getToken(ctx, p)
+	})
+}
+
+// refreshFor replaces rejected, a token of p's a server turned down, with a
+// new one. It goes through the agent if one is running, so the agent stops
+// handing out the rejected token too.
+func refreshFor(ctx context.Context, p *profile, rejected *dexy.Token) (*dexy.Token, error) {
+	return viaAgent(p, rejected.AccessToken, func() (*dexy.Token, error) {
+		return refreshToken(ctx, p, rejected)
+	})
+}
+
+// viaAgent asks the agent for p's token, one other than rejected if that
+// isn't empty, or calls local when there's no agent that can answer for p.
+func viaAgent(p *profile, rejected string, local func() (*dexy.Token, error)) (*dexy.Token, error) {
+	sock := os.Getenv(agentSockEnv)
+	if sock == "" || passwordGrant || p.ForceLogin {
+		return local()
+	}
+	tok, err := agentToken(sock, p, rejected)
+	if err == nil {
+		return tok, nil
+	}
+	if err == errAgentSettings {
+		return local()
+	}
+	if _, ok := err.(agentError); ok || err == dexy.ErrLoginRequired {
+		return nil, err
+	}
+	log.Printf("warning: could not reach dexy agent at %s, continuing without it: %v", sock, err)
+	return local()
+}
+
+// invalidateToken makes the next request for p's token fetch a new one,
+// for when the cached one has been rejected even though it hasn't expired.
+func invalidateToken(p *profile) error {
+	c, err := p.client()
+	if err != nil {
+		return err
+	}
+	return c.Invalidate()
+}
+
+// forgetToken removes every cached token for p.
+func forgetToken(p *profile) error {
+	c, err := p.client()
+	if err != nil {
+		return err
+	}
+	return c.Forget()
+}
+
+// refreshToken replaces rejected with a new token for p, unless the cache
+// already holds another one that is still valid.
+func refreshToken(ctx context.Context, p *profile, rejected *dexy.Token) (*dexy.Token, error) {
+	c, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	return c.Refresh(ctx, rejected)
+}
+
+// getToken returns the cached token for p if it is still valid, otherwise it
+// refreshes it or fetches a new one, and caches it.
+func getToken(ctx context.Context, p *profile) (*dexy.Token, error) {
+	if passwordGrant && !p.PasswordGrant {
+		return nil, fmt.Errorf("profile %q does not allow the password grant, set password_grant: true to enable it", p.Name)
+	}
+	c, err := p.client()
+	if err != nil {
+		return nil, err
+	}
+	return c.Token(ctx)
+}
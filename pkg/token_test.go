@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/chronojam/dexy/pkg/dexy/dexytest"
+	"github.com/spf13/viper"
+)
+
+// TestTokenForIsPerIssuerAndClient repoints a profile at another issuer and
+// client, which must not be handed the token cached for the first, whether
+// or not an agent is running.
+func TestTokenForIsPerIssuerAndClient(t *testing.T) {
+	for _, withAgent := range []bool{false, true} {
+		t.Run(fmt.Sprintf("agent %v", withAgent), func(t *testing.T) {
+			testTokenForIsPerIssuerAndClient(t, withAgent)
+		})
+	}
+}
+
+func testTokenForIsPerIssuerAndClient(t *testing.T, withAgent bool) {
+	first := useIssuer(t, "")
+	if withAgent {
+		startAgent(t)
+	}
+	second := dexytest.NewServer()
+	defer second.Close()
+
+	tests := []struct {
+		issuer   *dexytest.Issuer
+		clientID string
+	}{
+		{first, "ci"},
+		{second, "ci"},
+		{second, "deploy"},
+		{first, "ci"},
+	}
+	for _, tt := range tests {
+		viper.Set("profiles.default.dex_host", tt.issuer.URL)
+		viper.Set("profiles.default.client_id", tt.clientID)
+		p, err := loadProfile("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok, err := tokenFor(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c dexy.Claims
+		dexy.UnverifiedClaims(tok.AccessToken, &c)
+		if c.Issuer != tt.issuer.URL || c.Subject != tt.clientID {
+			t.Errorf("got a token from %s for %s, want one from %s for %s",
+				c.Issuer, c.Subject, tt.issuer.URL, tt.clientID)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package cmd
+
+// umask is a no-op on Windows, where files don't have Unix permissions.
+func umask(mask int) int {
+	return 0
+}
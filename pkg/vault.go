@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var vaultOpts struct {
+	addr      string
+	role      string
+	mount     string
+	namespace string
+	output    string
+}
+
+// vaultCmd logs in to Vault's JWT auth method with the profile's ID token.
+var vaultCmd = &cobra.Command{
+	Use:   "vault",
+	Short: "Print a Vault token from logging in with the profile's ID token",
+	Long: `Print a Vault token from logging in with the profile's ID token.
+
+The ID token is posted to the JWT auth method mounted at --mount, and the
+Vault token it returns is cached for its lease and renewed while it can be.
+With --output export the token is printed as shell export lines:
+
+  eval "$(dexy vault --role dev --output export)"`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := loadProfile(profileName)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		v, err := vaultFor(p)
+		if err != nil {
+			log.Fatalf("error while configuring vault %v", err)
+		}
+		tok, err := v.token(context.Background(), p)
+		if err != nil {
+			log.Fatalf("error while getting vault token %v", err)
+		}
+		switch vaultOpts.output {
+		case "token":
+			fmt.Println(tok.AccessToken)
+		case "export":
+			fmt.Printf("export VAULT_ADDR=%s\n", v.addr)
+			if v.namespace != "" {
+				fmt.Printf("export VAULT_NAMESPACE=%s\n", v.namespace)
+			}
+			fmt.Printf("export VAULT_TOKEN=%s\n", tok.AccessToken)
+		default:
+			log.Fatalf("unknown output format %q, use token or export", vaultOpts.output)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(vaultCmd)
+	flags := vaultCmd.Flags()
+	flags.StringVar(&vaultOpts.addr, "addr", "", "Vault address (default is the profile's vault.addr, then $VAULT_ADDR)")
+	flags.StringVar(&vaultOpts.role, "role", "", "JWT auth role to log in as (default is the profile's vault.role)")
+	flags.StringVar(&vaultOpts.mount, "mount", "", "path the JWT auth method is mounted at (default is the profile's vault.mount, then jwt)")
+	flags.StringVar(&vaultOpts.namespace, "namespace", "", "Vault namespace (default is the profile's vault.namespace, then $VAULT_NAMESPACE)")
+	flags.StringVarP(&vaultOpts.output, "output", "o", "token", "output format, token or export")
+}
+
+// vault is a Vault JWT auth method to log in to.
+type vault struct {
+	addr      string
+	role      string
+	mount     string
+	namespace string
+
+	// transport sends requests to Vault, http.DefaultTransport if nil.
+	transport http.RoundTripper
+}
+
+// vaultFor works out which Vault to log in to from the flags, then the
+// profile's vault settings, then Vault's own environment variables.
+func vaultFor(p *profile) (*vault, error) {
+	first := func(vals ...string) string {
+		for _, v := range vals {
+			if v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	v := &vault{
+		addr:      first(vaultOpts.addr, viper.GetString(p.key+".vault.addr"), os.Getenv("VAULT_ADDR")),
+		role:      first(vaultOpts.role, viper.GetString(p.key+".vault.role")),
+		mount:     first(vaultOpts.mount, viper.GetString(p.key+".vault.mount"), "jwt"),
+		namespace: first(vaultOpts.namespace, viper.GetString(p.key+".vault.namespace"), os.Getenv("VAULT_NAMESPACE")),
+	}
+	if v.addr == "" {
+		return nil, errors.New("no vault address, set --addr, vault.addr in the profile or VAULT_ADDR")
+	}
+	if v.role == "" {
+		return nil, errors.New("no role, set --role or vault.role in the profile")
+	}
+	v.addr = strings.TrimSuffix(v.addr, "/")
+	v.mount = strings.Trim(v.mount, "/")
+	if skip, _ := strconv.ParseBool(os.Getenv("VAULT_SKIP_VERIFY")); skip {
+		t, err := insecureTransport(v.addr)
+		if err != nil {
+			return nil, err
+		}
+		v.transport = t
+	}
+	return v, nil
+}
+
+// cacheKey is where the Vault token from logging in with p's ID token is
+// cached, which depends on the issuer and client behind p as much as on the
+// Vault role.
+func (v *vault) cacheKey(p *profile) string {
+	return p.CacheKey() + "#vault:" + url.Values{
+		"addr":      {v.addr},
+		"namespace": {v.namespace},
+		"mount":     {v.mount},
+		"role":      {v.role},
+	}.Encode()
+}
+
+// token returns the cached Vault token, renewing it once two thirds of its
+// lease has gone, or logs in again with the profile's ID token.
+func (v *vault) token(ctx context.Context, p *profile) (*dexy.Token, error) {
+	store := tokenCache()
+	key := v.cacheKey(p)
+	cached := store.Get(key)
+
+	if cached.ValidFor(time.Minute) {
+		lease, _ := strconv.Atoi(cached.Data["lease_duration"])
+		if cached.ValidFor(time.Duration(lease) * time.Second / 3) {
+			return cached, nil
+		}
+		if cached.Data["renewable"] == "true" {
+			tok, err := v.renew(ctx, cached.AccessToken)
+			if err == nil {
+				// A renewed token is still from the same login, as far as
+				// max_cache_lifetime is concerned.
+				tok.LoginTime = cached.LoginTime
+				return tok, store.Put(key, tok)
+			}
+			log.Printf("warning: could not renew vault token, logging in again: %v", err)
+		}
+	}
+
+	idToken, err := tokenFor(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := v.login(ctx, idToken.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	tok.LoginTime = idToken.LoginTime
+	if err := store.Put(key, tok); err != nil {
+		return nil, fmt.Errorf("error while attempting to write token to file %v", err)
+	}
+	return tok, nil
+}
+
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	Accessor      string `json:"accessor"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultResponse struct {
+	Auth   *vaultAuth `json:"auth"`
+	Errors []string   `json:"errors"`
+}
+
+func (v *vault) login(ctx context.Context, jwt string) (*dexy.Token, error) {
+	body := map[string]string{"role": v.role, "jwt": jwt}
+	return v.call(ctx, "auth/"+v.mount+"/login", "", body)
+}
+
+func (v *vault) renew(ctx context.Context, token string) (*dexy.Token, error) {
+	return v.call(ctx, "auth/token/renew-self", token, map[string]string{})
+}
+
+// call posts body to a Vault auth endpoint and turns the auth block of the
+// response into a dexy.Token.
+func (v *vault) call(ctx context.Context, path, token string, body interface{}) (*dexy.Token, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", v.addr+"/v1/"+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := (&http.Client{Transport: v.transport}).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var r vaultResponse
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return nil, fmt.Errorf("vault: %s: %s", resp.Status, respBody)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(r.Errors) > 0 {
+			return nil, fmt.Errorf("vault: %s", strings.Join(r.Errors, ", "))
+		}
+		return nil, fmt.Errorf("vault: %s", resp.Status)
+	}
+	if r.Auth == nil || r.Auth.ClientToken == "" {
+		return nil, errors.New("vault: response has no token")
+	}
+
+	// A lease of 0 means the token never expires. Log in again daily anyway,
+	// rather than caching it forever.
+	lease := time.Duration(r.Auth.LeaseDuration) * time.Second
+	if lease == 0 {
+		lease = 24 * time.Hour
+	}
+	return &dexy.Token{
+		AccessToken: r.Auth.ClientToken,
+		ExpiryTime:  time.Now().Add(lease),
+		Data: map[string]string{
+			"accessor":       r.Auth.Accessor,
+			"lease_duration": strconv.Itoa(int(lease.Seconds())),
+			"renewable":      strconv.FormatBool(r.Auth.Renewable),
+		},
+	}, nil
+}
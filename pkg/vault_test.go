@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+)
+
+// fakeVault serves a JWT auth method at auth/jwt and token renewal,
+// counting the logins and renewals it answers.
+type fakeVault struct {
+	*httptest.Server
+	renewable bool
+	failRenew bool
+	logins    int
+	renewals  int
+	namespace string
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	v := &fakeVault{renewable: true}
+	v.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.namespace = r.Header.Get("X-Vault-Namespace")
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		var token string
+		switch {
+		case r.URL.Path == "/v1/auth/jwt/login" && body["role"] == "dev" && strings.HasPrefix(body["jwt"], "ey"):
+			v.logins++
+			token = fmt.Sprintf("login-%d", v.logins)
+		case r.URL.Path == "/v1/auth/token/renew-self" && r.Header.Get("X-Vault-Token") != "" && !v.failRenew:
+			v.renewals++
+			token = fmt.Sprintf("renewed-%d", v.renewals)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"auth":{"client_token":%q,"accessor":"a","lease_duration":600,"renewable":%v}}`, token, v.renewable)
+	}))
+	t.Cleanup(v.Close)
+	return v
+}
+
+func TestVaultToken(t *testing.T) {
+	loginTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	cachedToken := func(validFor time.Duration, renewable bool) *dexy.Token {
+		return &dexy.Token{
+			AccessToken: "cached",
+			ExpiryTime:  time.Now().Add(validFor),
+			Data: map[string]string{
+				"lease_duration": "600",
+				"renewable":      strconv.FormatBool(renewable),
+			},
+			LoginTime: &loginTime,
+		}
+	}
+
+	tests := []struct {
+		name      string
+		cached    *dexy.Token
+		failRenew bool
+		want      string
+	}{
+		{"nothing cached", nil, false, "login-1"},
+		{"fresh", cachedToken(500*time.Second, true), false, "cached"},
+		{"two thirds of the lease gone", cachedToken(150*time.Second, true), false, "renewed-1"},
+		{"not renewable", cachedToken(150*time.Second, false), false, "login-1"},
+		{"renewal fails", cachedToken(150*time.Second, true), true, "login-1"},
+		{"about to expire", cachedToken(30*time.Second, true), false, "login-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeVault(t)
+			fake.failRenew = tt.failRenew
+			useIssuer(t, "    vault:\n      addr: "+fake.URL+"/\n      role: dev\n      namespace: team\n")
+			p, err := loadProfile("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := vaultFor(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.cached != nil {
+				if err := tokenCache().Put(v.cacheKey(p), tt.cached); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tok, err := v.token(context.Background(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.AccessToken != tt.want {
+				t.Errorf("got token %s, want %s", tok.AccessToken, tt.want)
+			}
+			if strings.HasPrefix(tt.want, "renewed") && (tok.LoginTime == nil || !tok.LoginTime.Equal(loginTime)) {
+				t.Errorf("renewed token's login time %v, want the cached %v", tok.LoginTime, loginTime)
+			}
+			if tt.want != "cached" && fake.namespace != "team" {
+				t.Errorf("sent namespace %q, want team", fake.namespace)
+			}
+			if got := tokenCache().Get(v.cacheKey(p)); got == nil || got.AccessToken != tt.want {
+				t.Errorf("cache holds %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVaultCacheKey(t *testing.T) {
+	useIssuer(t, "")
+	p, err := loadProfile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := vault{addr: "https://vault", mount: "jwt", role: "dev"}
+	keys := map[string]bool{base.cacheKey(p): true}
+	for _, v := range []vault{
+		{addr: "https://vault2", mount: "jwt", role: "dev"},
+		{addr: "https://vault", mount: "oidc", role: "dev"},
+		{addr: "https://vault", mount: "jwt", role: "prod"},
+		{addr: "https://vault", mount: "jwt", role: "dev", namespace: "team"},
+	} {
+		key := v.cacheKey(p)
+		if keys[key] {
+			t.Errorf("%+v has the same cache key as another vault", v)
+		}
+		keys[key] = true
+	}
+
+	// Nor may the same profile name logging in as another client share it.
+	p.ClientID = "other"
+	if keys[base.cacheKey(p)] {
+		t.Error("another client has the same cache key")
+	}
+}
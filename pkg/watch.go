@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chronojam/dexy/pkg/dexy"
+	"github.com/pressly/chi"
+	"github.com/spf13/cobra"
+)
+
+var watchOpts struct {
+	refreshAt  float64
+	tokenFiles []string
+	outputFile string
+	output     string
+	signal     string
+	pid        int
+	pidFile    string
+	hook       string
+	health     string
+	statusFile string
+	maxBackoff time.Duration
+}
+
+// watchCmd keeps a profile's token fresh for as long as it runs, for
+// sidecars and build agents that read the token from a file.
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Keep a profile's token fresh in files, refreshing it in the foreground",
+	Long: `Keep a profile's token fresh in files, refreshing it in the foreground.
+
+The token is refreshed once --refresh-at of its lifetime has passed. After
+every refresh the token files and the profile's sinks are rewritten, then
+--signal is sent to --pid (or the pid in --pid-file) and --hook is run.
+Failed refreshes are retried with jittered exponential backoff.
+
+--health serves GET /healthz, which answers 200 while the current token is
+valid and 503 once it has expired. --status-file is rewritten with the same
+status JSON after every attempt.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if watchOpts.refreshAt <= 0 || watchOpts.refreshAt >= 1 {
+			log.Fatalf("--refresh-at must be between 0 and 1")
+		}
+		if watchOpts.maxBackoff < time.Second {
+			log.Fatalf("--max-backoff must be at least 1s")
+		}
+		if watchOpts.outputFile != "" && !contains(outputFormats, watchOpts.output) {
+			log.Fatalf("unknown output format %q, must be one of %v", watchOpts.output, outputFormats)
+		}
+		if watchOpts.signal != "" {
+			if _, ok := namedSignals[strings.TrimPrefix(strings.ToUpper(watchOpts.signal), "SIG")]; !ok {
+				log.Fatalf("unknown signal %q", watchOpts.signal)
+			}
+		}
+		p, err := loadProfile(profileName)
+		if err != nil {
+			log.Fatalf("error while loading profile %v", err)
+		}
+		w := &watcher{p: p}
+		if watchOpts.health != "" {
+			r := chi.NewRouter()
+			r.Get("/healthz", w.serveHealth)
+			go func() {
+				log.Fatal(http.ListenAndServe(watchOpts.health, r))
+			}()
+		}
+		w.run()
+	},
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+	RootCmd.AddCommand(watchCmd)
+	flags := watchCmd.Flags()
+	flags.Float64Var(&watchOpts.refreshAt, "refresh-at", 0.75, "fraction of the token's lifetime after which to refresh it")
+	flags.StringArrayVar(&watchOpts.tokenFiles, "token-file", nil, "write the raw token to this file (can be repeated)")
+	flags.StringVar(&watchOpts.outputFile, "output-file", "", "write the token to this file in the --output format")
+	flags.StringVarP(&watchOpts.output, "output", "o", outputJSON, "format of --output-file, one of "+strings.Join(outputFormats, ", "))
+	flags.StringVar(&watchOpts.signal, "signal", "", "signal to send after each refresh, like HUP")
+	flags.IntVar(&watchOpts.pid, "pid", 0, "process to send --signal to")
+	flags.StringVar(&watchOpts.pidFile, "pid-file", "", "file holding the pid of the process to send --signal to")
+	flags.StringVar(&watchOpts.hook, "hook", "", "shell command to run after each refresh")
+	flags.StringVar(&watchOpts.health, "health", "", "address to serve /healthz on, like 127.0.0.1:8081")
+	flags.StringVar(&watchOpts.statusFile, "status-file", "", "file to write the watcher's status to after every attempt")
+	flags.DurationVar(&watchOpts.maxBackoff, "max-backoff", 5*time.Minute, "longest to wait between failed refreshes, at least 1s")
+}
+
+// watchStatus is what the health endpoint and status file report.
+type watchStatus struct {
+	Profile     string    `json:"profile"`
+	Healthy     bool      `json:"healthy"`
+	Expiry      time.Time `json:"expiry,omitempty"`
+	LastRefresh time.Time `json:"last_refresh,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	Failures    int       `json:"consecutive_failures"`
+}
+
+type watcher struct {
+	p *profile
+
+	mu          sync.Mutex
+	tok         *dexy.Token
+	lastRefresh time.Time
+	lastErr     error
+	failures    int
+}
+
+func (w *watcher) run() {
+	ctx := context.Background()
+	// The first token may need the user to log in, later ones never will.
+	tok, err := tokenFor(ctx, w.p)
+	if err != nil {
+		log.Fatalf("error while getting token %v", err)
+	}
+	w.p.NonInteractive = true
+	w.p.renderSinks(tok)
+	w.refreshed(tok)
+
+	for {
+		time.Sleep(time.Until(refreshTime(tok, watchOpts.refreshAt)))
+
+		var next *dexy.Token
+		for {
+			next, err = w.refresh(ctx, tok)
+			if err == nil {
+				break
+			}
+			w.failed(err)
+			time.Sleep(backoff(w.failures, watchOpts.maxBackoff))
+		}
+		tok = next
+		w.refreshed(tok)
+	}
+}
+
+// refresh gets a token to replace tok before it expires. The cached token
+// is left alone until there is a new one, so if refreshing fails tok is
+// still served until it expires.
+func (w *watcher) refresh(ctx context.Context, tok *dexy.Token) (*dexy.Token, error) {
+	// Asking for a token valid for longer than tok is makes the client
+	// refresh, unless someone else already has. Without a refresh token that
+	// would need a login, which w.p doesn't allow.
+	p := *w.p
+	p.MinValidity = time.Until(tok.ExpiryTime) + time.Second
+	next, err := tokenFor(ctx, &p)
+	if err == dexy.ErrLoginRequired {
+		return nil, fmt.Errorf("no refresh token, a new login is needed once the token expires at %s", tok.ExpiryTime.Format(time.RFC3339))
+	}
+	return next, err
+}
+
+func (w *watcher) refreshed(tok *dexy.Token) {
+	w.mu.Lock()
+	w.tok = tok
+	w.lastRefresh = time.Now()
+	w.lastErr = nil
+	w.failures = 0
+	w.mu.Unlock()
+	log.Printf("refreshed token for %s, valid until %s", w.p.Name, tok.ExpiryTime.Format(time.RFC3339))
+
+	for _, path := range watchOpts.tokenFiles {
+		if err := writeTokenFile(path, tok); err != nil {
+			log.Printf("error while writing token file %v", err)
+		}
+	}
+	if watchOpts.outputFile != "" {
+		if err := writeOutputFile(watchOpts.outputFile, watchOpts.output, tok); err != nil {
+			log.Printf("error while writing output file %v", err)
+		}
+	}
+	if watchOpts.signal != "" {
+		if err := signalWatched(); err != nil {
+			log.Printf("error while sending %s %v", watchOpts.signal, err)
+		}
+	}
+	if watchOpts.hook != "" {
+		hook := shellCommand(watchOpts.hook)
+		hook.Env = append(os.Environ(), tokenEnv(tok)...)
+		hook.Stdout = os.Stderr
+		hook.Stderr = os.Stderr
+		if err := hook.Run(); err != nil {
+			log.Printf("error while running hook %v", err)
+		}
+	}
+	w.writeStatus()
+}
+
+func (w *watcher) failed(err error) {
+	w.mu.Lock()
+	w.lastErr = err
+	w.failures++
+	w.mu.Unlock()
+	log.Printf("error while refreshing token %v", err)
+	w.writeStatus()
+}
+
+func (w *watcher) status() watchStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := watchStatus{
+		Profile:     w.p.Name,
+		Healthy:     w.tok.Valid(),
+		LastRefresh: w.lastRefresh,
+		Failures:    w.failures,
+	}
+	if w.tok != nil {
+		s.Expiry = w.tok.ExpiryTime
+	}
+	if w.lastErr != nil {
+		s.LastError = w.lastErr.Error()
+	}
+	return s
+}
+
+func (w *watcher) serveHealth(rw http.ResponseWriter, r *http.Request) {
+	s := w.status()
+	rw.Header().Set("Content-Type", "application/json")
+	if !s.Healthy {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(s)
+}
+
+func (w *watcher) writeStatus() {
+	if watchOpts.statusFile == "" {
+		return
+	}
+	b, err := json.MarshalIndent(w.status(), "", "  ")
+	if err == nil {
+		err = writeFileAtomic(watchOpts.statusFile, append(b, '\n'), 0644)
+	}
+	if err != nil {
+		log.Printf("error while writing status file %v", err)
+	}
+}
+
+// refreshTime is when fraction of tok's lifetime will have passed. The
+// lifetime starts at the token's iat claim, or now if it doesn't have one.
+func refreshTime(tok *dexy.Token, fraction float64) time.Time {
+	issued := time.Now()
+	var c dexy.Claims
+	if dexy.UnverifiedClaims(tok.AccessToken, &c) == nil && c.IssuedAt > 0 {
+		issued = time.Unix(c.IssuedAt, 0)
+	}
+	lifetime := tok.ExpiryTime.Sub(issued)
+	return issued.Add(time.Duration(float64(lifetime) * fraction))
+}
+
+// backoff is how long to wait after the nth consecutive failure: doubling
+// from a second up to max, with jitter so that many watchers failing at
+// once don't retry in step.
+func backoff(n int, max time.Duration) time.Duration {
+	d := max
+	if n < 30 {
+		d = time.Second << uint(n-1)
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// signalWatched sends --signal to the watched process.
+func signalWatched() error {
+	pid := watchOpts.pid
+	if watchOpts.pidFile != "" {
+		b, err := ioutil.ReadFile(watchOpts.pidFile)
+		if err != nil {
+			return err
+		}
+		if pid, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+			return fmt.Errorf("bad pid file %v", err)
+		}
+	}
+	if pid == 0 {
+		return errors.New("no process to signal, set --pid or --pid-file")
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(namedSignals[strings.TrimPrefix(strings.ToUpper(watchOpts.signal), "SIG")])
+}
+
+// writeOutputFile atomically replaces path with tok in the given format.
+func writeOutputFile(path, format string, tok *dexy.Token) error {
+	var buf bytes.Buffer
+	if err := writeToken(&buf, format, tok); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0600)
+}
+
+// writeFileAtomic replaces path with b, so readers never see half a file.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}